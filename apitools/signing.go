@@ -0,0 +1,192 @@
+package apitools
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Headers that carry the signature of a control request.
+const (
+	HeaderTimestamp = "X-Scaling-Timestamp"
+	HeaderNonce     = "X-Scaling-Nonce"
+	HeaderSignature = "X-Scaling-Signature"
+)
+
+// DefaultMaxSkew is how old, or how far in the future, a signed request can
+// be before it is refused.
+const DefaultMaxSkew = 30 * time.Second
+
+// MaxSignedBody caps how much of a request is read to check its signature.
+// Bodies are read before anything proves who sent them, so without a cap
+// anyone could make a generator run out of memory. It leaves room for the
+// largest request template body, 10MB, and the rest of the load request.
+const MaxSignedBody = 11 * 1024 * 1024
+
+// Signer signs requests with a secret shared with whoever receives them.
+type Signer struct {
+	Secret []byte
+}
+
+// Sign adds a timestamp, a random nonce and an HMAC of them and the request
+// to the request's headers. The body is read to be signed, and put back.
+func (s Signer) Sign(r *http.Request) error {
+	body, err := readBody(r)
+	if err != nil {
+		return err
+	}
+
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return fmt.Errorf("could not make nonce: %s", err)
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	n := hex.EncodeToString(nonce)
+
+	r.Header.Set(HeaderTimestamp, timestamp)
+	r.Header.Set(HeaderNonce, n)
+	r.Header.Set(HeaderSignature, signature(s.Secret, r, timestamp, n, body))
+
+	return nil
+}
+
+// Verifier checks the signatures of requests, and remembers nonces for long
+// enough to refuse a request that is replayed.
+type Verifier struct {
+	secret  []byte
+	maxSkew time.Duration
+
+	mu     sync.Mutex
+	nonces map[string]time.Time
+}
+
+// NewVerifier returns a verifier for requests signed with secret that are no
+// more than maxSkew old.
+func NewVerifier(secret []byte, maxSkew time.Duration) *Verifier {
+	return &Verifier{secret: secret, maxSkew: maxSkew, nonces: map[string]time.Time{}}
+}
+
+// Verify returns an error if the request isn't signed with the secret, is
+// too old, or has been seen before.
+func (v *Verifier) Verify(r *http.Request) error {
+	timestamp := r.Header.Get(HeaderTimestamp)
+	nonce := r.Header.Get(HeaderNonce)
+	sig := r.Header.Get(HeaderSignature)
+
+	if len(timestamp) == 0 || len(nonce) == 0 || len(sig) == 0 {
+		return errors.New("request is not signed")
+	}
+
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("request has a bad timestamp: %s", timestamp)
+	}
+
+	skew := time.Since(time.Unix(unix, 0))
+	if skew > v.maxSkew || skew < -v.maxSkew {
+		return fmt.Errorf("request is stale, it was signed %s ago", skew)
+	}
+
+	if r.Body != nil {
+		r.Body = http.MaxBytesReader(nil, r.Body, MaxSignedBody)
+	}
+
+	body, err := readBody(r)
+	if err != nil {
+		return err
+	}
+
+	expected := signature(v.secret, r, timestamp, nonce, body)
+	if !hmac.Equal([]byte(expected), []byte(sig)) {
+		return errors.New("request signature does not match")
+	}
+
+	return v.remember(nonce)
+}
+
+// remember records a nonce, failing if it has already been used. Nonces are
+// forgotten once requests using them would be stale anyway.
+func (v *Verifier) remember(nonce string) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	now := time.Now()
+	for n, expires := range v.nonces {
+		if now.After(expires) {
+			delete(v.nonces, n)
+		}
+	}
+
+	if _, ok := v.nonces[nonce]; ok {
+		return errors.New("request has already been used")
+	}
+	v.nonces[nonce] = now.Add(2 * v.maxSkew)
+
+	return nil
+}
+
+// Require wraps a handler so that it only sees requests that verify. Others
+// are answered with 401 Unauthorized.
+func (v *Verifier) Require(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := v.Verify(r); err != nil {
+			Respond(w, http.StatusUnauthorized, fmt.Sprintf("{\"error\":\"%s\"}", err))
+			return
+		}
+		h(w, r)
+	}
+}
+
+// signature is the hex HMAC of everything that identifies a request. The
+// host is part of it, so a request signed for one generator can't be
+// replayed against another.
+func signature(secret []byte, r *http.Request, timestamp, nonce string, body []byte) string {
+	sum := sha256.Sum256(body)
+
+	mac := hmac.New(sha256.New, secret)
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%s\n%s\n%x", r.Method, host(r), r.URL.RequestURI(), timestamp, nonce, sum)
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// host is the host a request is for. Outgoing requests usually leave Host
+// empty and send the one in the URL.
+func host(r *http.Request) string {
+	if len(r.Host) > 0 {
+		return strings.ToLower(r.Host)
+	}
+	return strings.ToLower(r.URL.Host)
+}
+
+// readBody reads the whole body of a request and puts it back so it can be
+// read again.
+func readBody(r *http.Request) ([]byte, error) {
+	if r.Body == nil {
+		return []byte{}, nil
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, fmt.Errorf("could not read request body: %s", err)
+	}
+	r.Body.Close()
+
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	r.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(body)), nil
+	}
+
+	return body, nil
+}
@@ -0,0 +1,143 @@
+package apitools
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+var secret = []byte("shared secret")
+
+func signedRequest(t *testing.T, body string) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, "http://generator/?job=1", strings.NewReader(body))
+	if err := (Signer{Secret: secret}).Sign(r); err != nil {
+		t.Fatalf("could not sign request: %s", err)
+	}
+	return r
+}
+
+func TestVerifyRoundTrip(t *testing.T) {
+	v := NewVerifier(secret, DefaultMaxSkew)
+	r := signedRequest(t, `{"url":"http://target"}`)
+
+	if err := v.Verify(r); err != nil {
+		t.Fatalf("signed request did not verify: %s", err)
+	}
+
+	// The body has to still be there for the handler.
+	body, err := readBody(r)
+	if err != nil {
+		t.Fatalf("could not read body after verifying: %s", err)
+	}
+	if string(body) != `{"url":"http://target"}` {
+		t.Errorf("body after verifying = %q", body)
+	}
+}
+
+func TestVerifyRejects(t *testing.T) {
+	cases := []struct {
+		name   string
+		verify func(v *Verifier) error
+	}{
+		{"unsigned", func(v *Verifier) error {
+			return v.Verify(httptest.NewRequest(http.MethodPost, "http://generator/", nil))
+		}},
+		{"wrong secret", func(v *Verifier) error {
+			r := httptest.NewRequest(http.MethodPost, "http://generator/", strings.NewReader("{}"))
+			(Signer{Secret: []byte("another secret")}).Sign(r)
+			return v.Verify(r)
+		}},
+		{"tampered body", func(v *Verifier) error {
+			r := signedRequest(t, `{"url":"http://target"}`)
+			signed := signedRequest(t, `{"url":"http://elsewhere"}`)
+			signed.Header = r.Header
+			return v.Verify(signed)
+		}},
+		{"tampered query", func(v *Verifier) error {
+			r := signedRequest(t, "{}")
+			r.URL.RawQuery = "job=2"
+			return v.Verify(r)
+		}},
+		{"another host", func(v *Verifier) error {
+			r := signedRequest(t, "{}")
+			r.Host = "other-generator"
+			return v.Verify(r)
+		}},
+		{"stale timestamp", func(v *Verifier) error {
+			r := signedRequest(t, "{}")
+			old := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+			r.Header.Set(HeaderTimestamp, old)
+			r.Header.Set(HeaderSignature, signature(secret, r, old, r.Header.Get(HeaderNonce), []byte("{}")))
+			return v.Verify(r)
+		}},
+		{"replayed nonce", func(v *Verifier) error {
+			r := signedRequest(t, "{}")
+			if err := v.Verify(r); err != nil {
+				t.Fatalf("first use did not verify: %s", err)
+			}
+			return v.Verify(r)
+		}},
+		{"body too large", func(v *Verifier) error {
+			return v.Verify(signedRequest(t, strings.Repeat("x", MaxSignedBody+1)))
+		}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			v := NewVerifier(secret, DefaultMaxSkew)
+			if err := c.verify(v); err == nil {
+				t.Errorf("request verified, want an error")
+			}
+		})
+	}
+}
+
+func TestRequire(t *testing.T) {
+	v := NewVerifier(secret, DefaultMaxSkew)
+	h := v.Require(func(w http.ResponseWriter, r *http.Request) {
+		Success(w, "ok")
+	})
+
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest(http.MethodPost, "http://generator/", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("unsigned request got %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+
+	w = httptest.NewRecorder()
+	h(w, signedRequest(t, "{}"))
+	if w.Code != http.StatusOK {
+		t.Errorf("signed request got %d, want %d", w.Code, http.StatusOK)
+	}
+}
+
+func TestVerifyOverHTTP(t *testing.T) {
+	v := NewVerifier(secret, DefaultMaxSkew)
+	srv := httptest.NewServer(v.Require(func(w http.ResponseWriter, r *http.Request) {
+		Success(w, "ok")
+	}))
+	defer srv.Close()
+
+	// Outgoing requests leave Host empty, so the signer has to sign the host
+	// in the URL, which is what the server sees.
+	r, err := http.NewRequest(http.MethodPost, srv.URL+"/?job=1", strings.NewReader("{}"))
+	if err != nil {
+		t.Fatalf("could not make request: %s", err)
+	}
+	if err := (Signer{Secret: secret}).Sign(r); err != nil {
+		t.Fatalf("could not sign request: %s", err)
+	}
+
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatalf("could not send request: %s", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("signed request got %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+}
@@ -2,18 +2,16 @@ package caching
 
 import (
 	"encoding/json"
-	"errors"
 	"fmt"
-	"io"
-	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
-	"strconv"
+	"sort"
 	"time"
 
 	"github.com/gomodule/redigo/redis"
 	"github.com/teris-io/shortid"
+	"github.com/tpryan/scaling/apitools"
 )
 
 // CreateID creates a unique ID for operators in this system.
@@ -27,12 +25,6 @@ func CreateID() (string, error) {
 	return sid.Generate()
 }
 
-// RedisPool is an interface that allows us to swap in an mock for testing cache
-// code.
-type RedisPool interface {
-	Get() redis.Conn
-}
-
 // ErrCacheMiss error indicates that an item is not in the cache
 var ErrCacheMiss = fmt.Errorf("item is not in cache")
 
@@ -40,17 +32,112 @@ var ErrCacheMiss = fmt.Errorf("item is not in cache")
 func NewCache(redisHost, redisPort string, debug bool) (*Cache, error) {
 	c := &Cache{}
 	pool := c.InitPool(redisHost, redisPort)
-	c.redisPool = pool
+	c.storage = &redisStorage{pool}
+	c.debug = debug
+	return c, nil
+}
+
+// NewMemoryCache returns an initialized cache that keeps everything in
+// process memory. It is meant for tests: the generator, receiver and
+// visualizer run as separate processes, so they can only see each other
+// through Redis.
+func NewMemoryCache(debug bool) (*Cache, error) {
+	c := &Cache{}
 	c.debug = debug
+	c.log("Initialized in memory storage")
+	c.storage = newMemoryStorage()
 	return c, nil
 }
 
+// DefaultResolution is the width of the buckets that hits are counted in.
+const DefaultResolution = time.Second
+
+// Lifecycle holds the thresholds used to infer the state of an instance from
+// when it was first and last seen.
+type Lifecycle struct {
+	// Warmup is how long after first being seen an instance is still warming.
+	Warmup time.Duration
+	// Idle is how long an instance can go without a hit before it is idle.
+	Idle time.Duration
+	// Terminated is how long an instance can go without a hit before it is
+	// presumed to have been shut down.
+	Terminated time.Duration
+}
+
+// DefaultLifecycle is the set of thresholds used unless SetLifecycle is called.
+var DefaultLifecycle = Lifecycle{
+	Warmup:     5 * time.Second,
+	Idle:       10 * time.Second,
+	Terminated: 5 * time.Minute,
+}
+
+// DefaultGeneratorTTL is how long a generator can go without a heartbeat
+// before it is considered stale.
+const DefaultGeneratorTTL = 10 * time.Second
+
 // Cache abstracts all of the operations of caching for the application
 type Cache struct {
-	// redisPool *redis.Pool
-	redisPool RedisPool
-	enabled   bool
-	debug     bool
+	storage      Storage
+	enabled      bool
+	debug        bool
+	resolution   time.Duration
+	lifecycle    *Lifecycle
+	generatorTTL time.Duration
+	reap         bool
+	signer       *apitools.Signer
+}
+
+// SetControlSecret makes the cache sign every request it sends to the
+// generators with the secret, which they share.
+func (c *Cache) SetControlSecret(secret string) {
+	if len(secret) == 0 {
+		c.signer = nil
+		return
+	}
+	c.signer = &apitools.Signer{Secret: []byte(secret)}
+}
+
+// sign signs a request to a generator if a control secret is set.
+func (c Cache) sign(r *http.Request) error {
+	if c.signer == nil {
+		return nil
+	}
+	return c.signer.Sign(r)
+}
+
+// SetGeneratorTTL changes how long a generator can go without a heartbeat
+// before it is considered stale. If reap is true, stale generators are removed
+// from storage as soon as they are noticed.
+func (c *Cache) SetGeneratorTTL(ttl time.Duration, reap bool) {
+	c.generatorTTL = ttl
+	c.reap = reap
+}
+
+// SetLifecycle changes the thresholds used to infer instance state.
+func (c *Cache) SetLifecycle(l Lifecycle) {
+	c.lifecycle = &l
+}
+
+// SetResolution changes the width of the time series buckets. Resolutions
+// are rounded down to whole seconds, with a floor of one second.
+func (c *Cache) SetResolution(d time.Duration) {
+	d = d.Truncate(time.Second)
+	if d < time.Second {
+		d = time.Second
+	}
+	c.resolution = d
+}
+
+func (c Cache) bucketWidth() int64 {
+	if c.resolution == 0 {
+		return int64(DefaultResolution / time.Second)
+	}
+	return int64(c.resolution / time.Second)
+}
+
+func (c Cache) bucket(t time.Time) int64 {
+	width := c.bucketWidth()
+	return t.Unix() - t.Unix()%width
 }
 
 func (c *Cache) log(msg string) {
@@ -73,277 +160,305 @@ func (c Cache) InitPool(redisHost, redisPort string) RedisPool {
 	return pool
 }
 
-// Clear removes all items from the cache.
-func (c Cache) Clear() error {
-	conn := c.redisPool.Get()
-	defer conn.Close()
+// DefaultRunID is the run that hits are recorded against until a run is
+// started.
+const DefaultRunID = "default"
 
-	if _, err := conn.Do("FLUSHALL"); err != nil {
-		return err
+// StartRun allocates a new run and makes it the one that hits are recorded
+// against. Earlier runs are kept.
+func (c Cache) StartRun(name string) (Run, error) {
+	id, err := CreateID()
+	if err != nil {
+		return Run{}, err
 	}
-	return nil
-}
-
-// Record a hit in redis
-func (c Cache) Record(instance Instance) error {
-
-	conn := c.redisPool.Get()
-	defer conn.Close()
 
-	conn.Send("MULTI")
-
-	if err := conn.Send("HSET", "index", instance.ID, instance.Env); err != nil {
-		return err
+	if len(name) == 0 {
+		name = id
 	}
 
-	if err := conn.Send("INCR", instance.ID); err != nil {
-		return err
+	r := Run{ID: id, Name: name, Started: time.Now()}
+	if err := c.storage.StartRun(r); err != nil {
+		return r, err
 	}
 
-	if _, err := conn.Do("EXEC"); err != nil {
-		return err
-	}
+	return r, nil
+}
 
-	return nil
+// CurrentRun returns the run that hits are being recorded against.
+func (c Cache) CurrentRun() (Run, error) {
+	r, err := c.storage.CurrentRun()
+	if err == ErrCacheMiss {
+		return Run{ID: DefaultRunID, Name: DefaultRunID}, nil
+	}
+	return r, err
 }
 
-// RegisterGenerator registers a load producing node.
-func (c Cache) RegisterGenerator(nodeID, ip string, active bool) error {
+// Runs returns every run that can still be queried, including the default
+// run.
+func (c Cache) Runs() (Runs, error) {
+	runs, err := c.storage.Runs()
+	if err != nil && err != ErrCacheMiss {
+		return runs, err
+	}
 
-	conn := c.redisPool.Get()
-	defer conn.Close()
+	runs = append(Runs{{ID: DefaultRunID, Name: DefaultRunID}}, runs...)
+	sort.Slice(runs, func(i, j int) bool {
+		return runs[i].Started.Before(runs[j].Started)
+	})
 
-	node := Generator{nodeID, ip, active}
+	return runs, nil
+}
 
-	nodestr, err := node.JSON()
+// ClearRun removes a run and everything recorded against it. An empty run
+// clears the current one. No other run is touched.
+func (c Cache) ClearRun(run string) error {
+	run, err := c.runID(run)
 	if err != nil {
 		return err
 	}
 
-	if _, err := conn.Do("HSET", "loadnodes", ip, nodestr); err != nil {
-		return fmt.Errorf("cannot set loadnodes in redis: %s", err)
-	}
-
-	return nil
+	return c.storage.ClearRun(run)
 }
 
-// RegisterReceiver registers a receiver endpoint.
-func (c Cache) RegisterReceiver(env, endpoint string) error {
-
-	conn := c.redisPool.Get()
-	defer conn.Close()
+// runID resolves an empty run to the current one.
+func (c Cache) runID(run string) (string, error) {
+	if len(run) > 0 {
+		return run, nil
+	}
 
-	r := Receiver{env, endpoint}
+	// Only the ID is needed, which saves a round trip on every hit.
+	id, err := c.storage.CurrentRunID()
+	if err == ErrCacheMiss {
+		return DefaultRunID, nil
+	}
+	return id, err
+}
 
-	rstr, err := r.JSON()
+// Record a hit in the cache against the current run, both in the running
+// total and in the time series bucket for the current time.
+func (c Cache) Record(instance Instance) error {
+	run, err := c.runID("")
 	if err != nil {
 		return err
 	}
 
-	if _, err := conn.Do("HSET", "receivers", endpoint, rstr); err != nil {
+	now := time.Now()
+	return c.storage.Record(run, instance, now, c.bucket(now))
+}
+
+// RecordTermination notes that an instance is shutting down, which is the
+// scale down event that is otherwise only inferred from the instance going
+// quiet.
+func (c Cache) RecordTermination(instance Instance) error {
+	run, err := c.runID("")
+	if err != nil {
 		return err
 	}
 
-	return nil
+	return c.storage.RecordTermination(run, instance, time.Now())
 }
 
-// InstanceReport returns the whole collection of all of the instances
-func (c Cache) InstanceReport() (InstanceReport, error) {
-	index := InstanceReport{}
-	keys := []interface{}{}
-	intkeys := []string{}
+// RemoveGenerator deregisters a load producing node, like one that is
+// shutting down.
+func (c Cache) RemoveGenerator(ip string) error {
+	return c.storage.RemoveGenerator(ip)
+}
 
-	conn := c.redisPool.Get()
-	defer conn.Close()
+// RegisterGenerator registers a load producing node, stamping it with a
+// heartbeat.
+func (c Cache) RegisterGenerator(nodeID, ip string, active bool) error {
+	return c.SaveGenerator(Generator{ID: nodeID, IP: ip, Active: active})
+}
 
-	s, err := redis.StringMap(conn.Do("HGETALL", "index"))
-	if err == redis.ErrNil {
-		return index, ErrCacheMiss
-	} else if err != nil {
-		return index, err
-	}
+// SaveGenerator registers a load producing node along with what it is working
+// on, stamping it with a heartbeat.
+func (c Cache) SaveGenerator(g Generator) error {
+	g.Heartbeat = time.Now()
+	g.Stale = false
+	return c.storage.RegisterGenerator(g)
+}
 
-	for id, env := range s {
-		ins := Instance{id, env, 0}
-		index[id] = ins
-		keys = append(keys, id)
-		intkeys = append(intkeys, id)
+// RegisterReceiver registers a receiver endpoint.
+func (c Cache) RegisterReceiver(env, endpoint string) error {
+	return c.RegisterReceiverWithHealth(env, endpoint, "")
+}
+
+// RegisterReceiverWithHealth registers a receiver that answers health checks
+// somewhere other than the /healthz worked out from its endpoint.
+func (c Cache) RegisterReceiverWithHealth(env, endpoint, health string) error {
+	return c.storage.RegisterReceiver(Receiver{Env: env, Endpoint: endpoint, HealthEndpoint: health})
+}
+
+// InstanceReport returns the whole collection of all of the instances in a
+// run, with their state inferred from when they were last seen. An empty run
+// reports on the current one.
+func (c Cache) InstanceReport(run string) (InstanceReport, error) {
+	run, err := c.runID(run)
+	if err != nil {
+		return InstanceReport{}, err
 	}
 
-	counts, err := redis.Strings(conn.Do("MGET", keys...))
-	if err == redis.ErrNil {
-		return index, ErrCacheMiss
-	} else if err != nil {
+	index, err := c.storage.InstanceReport(run)
+	if err != nil {
 		return index, err
 	}
 
-	for idx, count := range counts {
-
-		id := intkeys[idx]
-
-		ins, ok := index[id]
-		if !ok {
-			return index, fmt.Errorf("could not get instance from index")
-		}
-
-		c, err := strconv.Atoi(count)
-		if err != nil {
-			return index, fmt.Errorf("could not get count for instance")
-		}
+	l := DefaultLifecycle
+	if c.lifecycle != nil {
+		l = *c.lifecycle
+	}
 
-		ins.Count = c
+	now := time.Now()
+	for id, ins := range index {
+		ins.State = ins.infer(now, l)
 		index[id] = ins
-
 	}
 
 	return index, nil
 }
 
-// Generators returns the whole collection of all of the load nodes
-func (c Cache) Generators() (Generators, error) {
-	keys := Generators{}
-
-	conn := c.redisPool.Get()
-	defer conn.Close()
+// Series returns the hits per instance and per environment of a run between
+// from and to, bucketed at the resolution of the cache. An empty run reports
+// on the current one.
+func (c Cache) Series(run string, from, to time.Time) (SeriesReport, error) {
+	run, err := c.runID(run)
+	if err != nil {
+		return SeriesReport{}, err
+	}
 
-	s, err := redis.StringMap(conn.Do("HGETALL", "loadnodes"))
-	if err == redis.ErrNil {
-		return keys, ErrCacheMiss
-	} else if err != nil {
-		return keys, err
+	report, err := c.storage.Series(run, c.bucket(from), to.Unix())
+	if err != nil {
+		return report, err
 	}
 
-	for _, v := range s {
-		node := Generator{}
-		err := node.Load(v)
-		if err != nil {
-			return keys, err
-		}
+	width := c.bucketWidth()
+	report.From = time.Unix(c.bucket(from), 0)
+	report.To = to
+	report.Resolution = width
 
-		keys = append(keys, node)
+	for id, s := range report.Instances {
+		report.Instances[id] = s.rebucket(width)
 	}
 
-	return keys, nil
-}
-
-// Receivers returns the whole collection of all of the receivers
-func (c Cache) Receivers() (Receivers, error) {
-	keys := Receivers{}
+	for env, s := range report.Envs {
+		report.Envs[env] = s.rebucket(width)
+	}
 
-	conn := c.redisPool.Get()
-	defer conn.Close()
+	return report, nil
+}
 
-	s, err := redis.StringMap(conn.Do("HGETALL", "receivers"))
-	if err == redis.ErrNil {
-		return keys, ErrCacheMiss
-	} else if err != nil {
-		return keys, err
+// Generators returns the load nodes that have sent a heartbeat within the
+// generator TTL.
+func (c Cache) Generators() (Generators, error) {
+	all, err := c.AllGenerators()
+	if err != nil {
+		return all, err
 	}
 
-	for _, v := range s {
-		r := Receiver{}
-		err := r.Load(v)
-		if err != nil {
-			return keys, err
+	live := Generators{}
+	for _, v := range all {
+		if !v.Stale {
+			live = append(live, v)
 		}
-
-		keys = append(keys, r)
 	}
 
-	return keys, nil
+	return live, nil
 }
 
-func (c Cache) calcRates(n string, cc string, count int) (string, string, error) {
-	nInt, err := strconv.Atoi(n)
+// AllGenerators returns the whole collection of all of the load nodes, with
+// the ones that have missed their heartbeat marked as stale. If reaping is on,
+// stale nodes are removed from storage but still returned this one time.
+func (c Cache) AllGenerators() (Generators, error) {
+	list, err := c.storage.Generators()
 	if err != nil {
-		return "", "", errors.New("Could not get valid value for `n`: " + n)
+		return list, err
 	}
 
-	cInt, err := strconv.Atoi(cc)
-	if err != nil {
-		return "", "", fmt.Errorf("could not get valid value for env variable `TARGET_QPS`: %s", cc)
+	ttl := c.generatorTTL
+	if ttl == 0 {
+		ttl = DefaultGeneratorTTL
 	}
 
-	nodeN := nInt / count
-	nodeC := cInt / count
+	now := time.Now()
+	for i, v := range list {
+		list[i].Stale = now.Sub(v.Heartbeat) > ttl
+		if !list[i].Stale || !c.reap {
+			continue
+		}
 
-	// Ensures that C never exceeds N cause if that happens Apache Bench fails.
-	if nodeC > nodeN {
-		nodeC = nodeN
+		c.log(fmt.Sprintf("Reaping stale generator %s at %s", v.ID, v.IP))
+		if err := c.storage.RemoveGenerator(v.IP); err != nil {
+			return list, err
+		}
 	}
-	return strconv.Itoa(nodeN), strconv.Itoa(nodeC), nil
-}
-
-// Distribute splits the load request among the active load generators
-func (c Cache) Distribute(n, con, urlToHit, token string) (ABResponses, error) {
-	ab := ABResponses{}
 
-	list, err := c.Generators()
-
-	if err != nil {
-		return ab, err
-	}
+	return list, nil
+}
 
-	listlen := len(list)
+// Receivers returns the whole collection of all of the receivers
+func (c Cache) Receivers() (Receivers, error) {
+	return c.storage.Receivers()
+}
 
-	if listlen == 0 {
-		return ab, fmt.Errorf("there are no load nodes registered")
-	}
+// Run is a named window of load testing that hits are recorded against.
+type Run struct {
+	ID      string    `json:"id"`
+	Name    string    `json:"name"`
+	Started time.Time `json:"started"`
+}
 
-	out := make(chan ABResponse)
-	errs := make(chan error)
+// JSON Returns the given Run struct as a JSON string
+func (r Run) JSON() (string, error) {
 
-	perN, perC, err := c.calcRates(n, con, listlen)
+	bytes, err := json.Marshal(r)
 	if err != nil {
-		return ab, err
+		return "", fmt.Errorf("could not marshal json for response: %s", err)
 	}
 
-	for _, v := range list {
-
-		go func(ip, n, concur, url, token string) {
-			resp, err := c.send(ip, n, concur, url, token)
-			if err != nil {
-				errs <- err
-				return
-			}
-			out <- resp
-		}(v.IP, perN, perC, urlToHit, token)
+	return string(bytes), nil
+}
 
-	}
+// Load populates a structure with data from json.
+func (r *Run) Load(j string) error {
 
-	for i := 0; i < listlen; i++ {
-		select {
-		case res := <-out:
-			ab = append(ab, res)
-		case err := <-errs:
-			return ab, err
-		}
+	if err := json.Unmarshal([]byte(j), r); err != nil {
+		return err
 	}
-
-	return ab, nil
+	return nil
 }
 
-func (c Cache) send(ip, discount, concur, url, token string) (ABResponse, error) {
-	ab := ABResponse{}
-	u := fmt.Sprintf("http://%s?n=%s&c=%s&url=%s&token=%s", ip, discount, concur, url, token)
+// Runs is a slice of Runs
+type Runs []Run
 
-	response, err := http.Get(u)
+// JSON Returns the given Runs slice as a JSON string
+func (r Runs) JSON() (string, error) {
+
+	bytes, err := json.Marshal(r)
 	if err != nil {
-		return ab, err
+		return "", fmt.Errorf("could not marshal json for response: %s", err)
 	}
-	defer response.Body.Close()
-
-	resp := ABResponse{}
-	resp.Load(response.Body)
 
-	return resp, nil
+	return string(bytes), nil
 }
 
 // Generator represents a load generator
 type Generator struct {
-	ID     string `json:"id"`
-	IP     string `json:"ip"`
-	Active bool   `json:"active"`
+	ID string `json:"id"`
+	// IP is where the generator is sent load requests, as host or
+	// host:port, made from Address and Port.
+	IP string `json:"ip"`
+	// Address and Port are what the generator advertised, and Discovery is
+	// how it found them.
+	Address   string    `json:"address,omitempty"`
+	Port      string    `json:"port,omitempty"`
+	Discovery string    `json:"discovery,omitempty"`
+	Active    bool      `json:"active"`
+	Heartbeat time.Time `json:"heartbeat"`
+	Stale     bool      `json:"stale"`
+	// CurrentJob is the job of the run in progress, if it has one.
+	CurrentJob string `json:"currentjob,omitempty"`
+	// QueueDepth is how many runs are waiting for the current one to end.
+	QueueDepth int `json:"queuedepth"`
 }
 
 // JSON Returns the given Node slice as a JSON string
@@ -380,11 +495,46 @@ func (i Generators) JSON() (string, error) {
 	return string(bytes), nil
 }
 
+// States an instance can be inferred to be in.
+const (
+	InstanceWarming            = "warming"
+	InstanceServing            = "serving"
+	InstanceIdle               = "idle"
+	InstancePresumedTerminated = "presumed-terminated"
+	// InstanceTerminated is not inferred: the instance said it was shutting
+	// down.
+	InstanceTerminated = "terminated"
+)
+
 // Instance is a record of one instantiation of a load receiver.
 type Instance struct {
-	ID    string `json:"id"`
-	Env   string `json:"env"`
-	Count int    `json:"count"`
+	ID        string    `json:"id"`
+	Env       string    `json:"env"`
+	Count     int       `json:"count"`
+	FirstSeen time.Time `json:"firstseen"`
+	LastSeen  time.Time `json:"lastseen"`
+	// Terminated is when the instance reported that it was shutting down,
+	// if it did.
+	Terminated time.Time `json:"terminated"`
+	State      string    `json:"state,omitempty"`
+}
+
+// infer works out the state of the instance at a point in time.
+func (i Instance) infer(now time.Time, l Lifecycle) string {
+	silent := now.Sub(i.LastSeen)
+
+	switch {
+	case !i.Terminated.IsZero():
+		return InstanceTerminated
+	case silent >= l.Terminated:
+		return InstancePresumedTerminated
+	case silent >= l.Idle:
+		return InstanceIdle
+	case now.Sub(i.FirstSeen) < l.Warmup:
+		return InstanceWarming
+	}
+
+	return InstanceServing
 }
 
 // Incr adds to the instance counter
@@ -417,46 +567,55 @@ func (i InstanceReport) JSON() (string, error) {
 	return string(bytes), nil
 }
 
-// ABResponse is an extreme summary of the response from Apache Bench
-type ABResponse struct {
-	Token  string
-	IP     string
-	Status string
+// Point is the count of hits in one time series bucket.
+type Point struct {
+	Time  time.Time `json:"time"`
+	Count int       `json:"count"`
 }
 
-// JSON Returns the given ABResponse struct as a JSON string
-func (a ABResponse) JSON() (string, error) {
-
-	bytes, err := json.Marshal(a)
-	if err != nil {
-		return "", fmt.Errorf("could not marshal json for response: %s", err)
-	}
-
-	return string(bytes), nil
+// Series is a count of hits over time for either one instance or one
+// environment.
+type Series struct {
+	ID     string  `json:"id"`
+	Env    string  `json:"env"`
+	Points []Point `json:"points"`
 }
 
-// Load takes the content of a http response and creates a struct of it.
-func (a *ABResponse) Load(r io.Reader) error {
-
-	bodyBytes, err := ioutil.ReadAll(r)
-	if err != nil {
-		log.Fatal(err)
+// rebucket folds the points into buckets of width seconds and sorts them by
+// time.
+func (s Series) rebucket(width int64) Series {
+	counts := map[int64]int{}
+	for _, p := range s.Points {
+		t := p.Time.Unix()
+		counts[t-t%width] += p.Count
 	}
 
-	if err := json.Unmarshal(bodyBytes, &a); err != nil {
-		return fmt.Errorf("could not marshal json for response: %s", err)
+	s.Points = []Point{}
+	for t, count := range counts {
+		s.Points = append(s.Points, Point{time.Unix(t, 0), count})
 	}
 
-	return nil
+	sort.Slice(s.Points, func(i, j int) bool {
+		return s.Points[i].Time.Before(s.Points[j].Time)
+	})
+
+	return s
 }
 
-// ABResponses is a list of ABResponses
-type ABResponses []ABResponse
+// SeriesReport is the collection of time series for a window of time, keyed
+// by instance ID and by environment.
+type SeriesReport struct {
+	From       time.Time         `json:"from"`
+	To         time.Time         `json:"to"`
+	Resolution int64             `json:"resolution"`
+	Instances  map[string]Series `json:"instances"`
+	Envs       map[string]Series `json:"envs"`
+}
 
-// JSON Returns the given ABResponse struct as a JSON string
-func (a ABResponses) JSON() (string, error) {
+// JSON Returns the given SeriesReport struct as a JSON string
+func (s SeriesReport) JSON() (string, error) {
 
-	bytes, err := json.Marshal(a)
+	bytes, err := json.Marshal(s)
 	if err != nil {
 		return "", fmt.Errorf("could not marshal json for response: %s", err)
 	}
@@ -468,6 +627,10 @@ func (a ABResponses) JSON() (string, error) {
 type Receiver struct {
 	Env      string `json:"env"`
 	Endpoint string `json:"endpoint"`
+	// HealthEndpoint is where the receiver answers health checks, for
+	// receivers that can't serve /healthz next to /record.
+	HealthEndpoint string          `json:"healthendpoint,omitempty"`
+	Health         *ReceiverHealth `json:"health,omitempty"`
 }
 
 // JSON Returns the given Recevier struct as a JSON string
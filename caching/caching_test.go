@@ -0,0 +1,317 @@
+package caching
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestCache(t *testing.T) Cache {
+	c, err := NewMemoryCache(false)
+	if err != nil {
+		t.Fatalf("NewMemoryCache() got error: %s", err)
+	}
+	return *c
+}
+
+func TestRuns(t *testing.T) {
+	c := newTestCache(t)
+
+	current, err := c.CurrentRun()
+	if err != nil {
+		t.Fatalf("CurrentRun() got error: %s", err)
+	}
+	if current.ID != DefaultRunID {
+		t.Errorf("CurrentRun() before any run = %s, want %s", current.ID, DefaultRunID)
+	}
+
+	if err := c.Record(Instance{ID: "a", Env: "gke"}); err != nil {
+		t.Fatalf("Record() got error: %s", err)
+	}
+
+	first, err := c.StartRun("first")
+	if err != nil {
+		t.Fatalf("StartRun() got error: %s", err)
+	}
+	if err := c.Record(Instance{ID: "b", Env: "gke"}); err != nil {
+		t.Fatalf("Record() got error: %s", err)
+	}
+
+	second, err := c.StartRun("")
+	if err != nil {
+		t.Fatalf("StartRun() got error: %s", err)
+	}
+	if second.Name != second.ID {
+		t.Errorf("StartRun(\"\") named the run %s, want its ID %s", second.Name, second.ID)
+	}
+
+	current, err = c.CurrentRun()
+	if err != nil {
+		t.Fatalf("CurrentRun() got error: %s", err)
+	}
+	if current.ID != second.ID {
+		t.Errorf("CurrentRun() = %s, want %s", current.ID, second.ID)
+	}
+
+	runs, err := c.Runs()
+	if err != nil {
+		t.Fatalf("Runs() got error: %s", err)
+	}
+	want := []string{DefaultRunID, first.ID, second.ID}
+	if len(runs) != len(want) {
+		t.Fatalf("Runs() got %d runs, want %d", len(runs), len(want))
+	}
+	for i, id := range want {
+		if runs[i].ID != id {
+			t.Errorf("Runs()[%d] = %s, want %s", i, runs[i].ID, id)
+		}
+	}
+
+	// Hits are kept apart by run.
+	for run, id := range map[string]string{DefaultRunID: "a", first.ID: "b"} {
+		index, err := c.InstanceReport(run)
+		if err != nil {
+			t.Fatalf("InstanceReport(%s) got error: %s", run, err)
+		}
+		if len(index) != 1 || index[id].Count != 1 {
+			t.Errorf("InstanceReport(%s) = %v, want one hit on %s", run, index, id)
+		}
+	}
+
+	if err := c.ClearRun(first.ID); err != nil {
+		t.Fatalf("ClearRun() got error: %s", err)
+	}
+
+	index, err := c.InstanceReport(first.ID)
+	if err != nil {
+		t.Fatalf("InstanceReport() got error: %s", err)
+	}
+	if len(index) != 0 {
+		t.Errorf("InstanceReport() of a cleared run = %v, want nothing", index)
+	}
+
+	index, err = c.InstanceReport(DefaultRunID)
+	if err != nil {
+		t.Fatalf("InstanceReport() got error: %s", err)
+	}
+	if len(index) != 1 {
+		t.Errorf("ClearRun() touched another run, which now has %v", index)
+	}
+
+	runs, err = c.Runs()
+	if err != nil {
+		t.Fatalf("Runs() got error: %s", err)
+	}
+	if len(runs) != 2 {
+		t.Errorf("Runs() after ClearRun() got %d runs, want 2", len(runs))
+	}
+}
+
+func TestSeriesRebucketing(t *testing.T) {
+	c := newTestCache(t)
+
+	base := time.Unix(1000000, 0)
+	hits := []struct {
+		id     string
+		env    string
+		offset int64
+	}{
+		{"a", "gke", 0},
+		{"a", "gke", 1},
+		{"b", "gke", 4},
+		{"a", "gke", 5},
+		{"b", "run", 9},
+		{"b", "run", 10},
+	}
+
+	// Hits are stored at one second buckets, as they would have been
+	// before the resolution was changed.
+	for _, h := range hits {
+		at := base.Add(time.Duration(h.offset) * time.Second)
+		if err := c.storage.Record(DefaultRunID, Instance{ID: h.id, Env: h.env}, at, at.Unix()); err != nil {
+			t.Fatalf("Record() got error: %s", err)
+		}
+	}
+
+	c.SetResolution(5500 * time.Millisecond)
+
+	report, err := c.Series("", base.Add(2*time.Second), base.Add(20*time.Second))
+	if err != nil {
+		t.Fatalf("Series() got error: %s", err)
+	}
+
+	if report.Resolution != 5 {
+		t.Errorf("Series() resolution = %d, want 5", report.Resolution)
+	}
+	if !report.From.Equal(base) {
+		t.Errorf("Series() from = %s, want it rounded down to %s", report.From, base)
+	}
+
+	tests := map[string]struct {
+		series Series
+		want   map[int64]int
+	}{
+		"instance a": {report.Instances["a"], map[int64]int{0: 2, 5: 1}},
+		"instance b": {report.Instances["b"], map[int64]int{0: 1, 5: 1, 10: 1}},
+		"env gke":    {report.Envs["gke"], map[int64]int{0: 3, 5: 1}},
+		"env run":    {report.Envs["run"], map[int64]int{5: 1, 10: 1}},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			if len(tc.series.Points) != len(tc.want) {
+				t.Fatalf("got %d points, want %d: %v", len(tc.series.Points), len(tc.want), tc.series.Points)
+			}
+
+			last := time.Time{}
+			for _, p := range tc.series.Points {
+				if p.Time.Before(last) {
+					t.Errorf("points are out of order: %v", tc.series.Points)
+				}
+				last = p.Time
+
+				offset := p.Time.Unix() - base.Unix()
+				if p.Count != tc.want[offset] {
+					t.Errorf("point at +%ds = %d, want %d", offset, p.Count, tc.want[offset])
+				}
+			}
+		})
+	}
+}
+
+func TestLifecycle(t *testing.T) {
+	c := newTestCache(t)
+	c.SetLifecycle(Lifecycle{Warmup: time.Minute, Idle: 2 * time.Minute, Terminated: time.Hour})
+
+	now := time.Now()
+	hits := []struct {
+		id    string
+		first time.Duration
+		last  time.Duration
+	}{
+		{"warming", 30 * time.Second, 0},
+		{"serving", 10 * time.Minute, 0},
+		{"idle", 10 * time.Minute, 5 * time.Minute},
+		{"gone", 3 * time.Hour, 2 * time.Hour},
+		{"terminated", 10 * time.Minute, 0},
+	}
+
+	for _, h := range hits {
+		for _, ago := range []time.Duration{h.first, h.last} {
+			at := now.Add(-ago)
+			if err := c.storage.Record(DefaultRunID, Instance{ID: h.id}, at, at.Unix()); err != nil {
+				t.Fatalf("Record() got error: %s", err)
+			}
+		}
+	}
+
+	if err := c.RecordTermination(Instance{ID: "terminated"}); err != nil {
+		t.Fatalf("RecordTermination() got error: %s", err)
+	}
+	// An instance that was never seen can't be terminated.
+	if err := c.RecordTermination(Instance{ID: "unknown"}); err != nil {
+		t.Fatalf("RecordTermination() got error: %s", err)
+	}
+
+	index, err := c.InstanceReport("")
+	if err != nil {
+		t.Fatalf("InstanceReport() got error: %s", err)
+	}
+
+	want := map[string]string{
+		"warming":    InstanceWarming,
+		"serving":    InstanceServing,
+		"idle":       InstanceIdle,
+		"gone":       InstancePresumedTerminated,
+		"terminated": InstanceTerminated,
+	}
+
+	if len(index) != len(want) {
+		t.Errorf("InstanceReport() got %d instances, want %d", len(index), len(want))
+	}
+
+	for id, state := range want {
+		if got := index[id].State; got != state {
+			t.Errorf("instance %s is %s, want %s", id, got, state)
+		}
+		if got := index[id].Count; got != 2 {
+			t.Errorf("instance %s has %d hits, want 2", id, got)
+		}
+	}
+}
+
+func TestGeneratorStaleness(t *testing.T) {
+	tests := map[string]struct {
+		reap      bool
+		wantAfter int
+	}{
+		"kept":   {false, 2},
+		"reaped": {true, 1},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			c := newTestCache(t)
+			c.SetGeneratorTTL(time.Minute, tc.reap)
+
+			if err := c.RegisterGenerator("fresh", "10.0.0.1:8080", true); err != nil {
+				t.Fatalf("RegisterGenerator() got error: %s", err)
+			}
+			old := Generator{ID: "old", IP: "10.0.0.2:8080", Heartbeat: time.Now().Add(-2 * time.Minute)}
+			if err := c.storage.RegisterGenerator(old); err != nil {
+				t.Fatalf("RegisterGenerator() got error: %s", err)
+			}
+
+			all, err := c.AllGenerators()
+			if err != nil {
+				t.Fatalf("AllGenerators() got error: %s", err)
+			}
+			if len(all) != 2 {
+				t.Fatalf("AllGenerators() got %d generators, want 2", len(all))
+			}
+			for _, g := range all {
+				if g.Stale != (g.ID == "old") {
+					t.Errorf("generator %s stale = %t", g.ID, g.Stale)
+				}
+			}
+
+			live, err := c.Generators()
+			if err != nil {
+				t.Fatalf("Generators() got error: %s", err)
+			}
+			if len(live) != 1 || live[0].ID != "fresh" {
+				t.Errorf("Generators() = %v, want only fresh", live)
+			}
+
+			all, err = c.AllGenerators()
+			if err != nil {
+				t.Fatalf("AllGenerators() got error: %s", err)
+			}
+			if len(all) != tc.wantAfter {
+				t.Errorf("AllGenerators() a second time got %d generators, want %d", len(all), tc.wantAfter)
+			}
+
+			// A heartbeat brings a generator back.
+			if err := c.RegisterGenerator("old", "10.0.0.2:8080", false); err != nil {
+				t.Fatalf("RegisterGenerator() got error: %s", err)
+			}
+			live, err = c.Generators()
+			if err != nil {
+				t.Fatalf("Generators() got error: %s", err)
+			}
+			if len(live) != 2 {
+				t.Errorf("Generators() after a heartbeat got %d generators, want 2", len(live))
+			}
+
+			if err := c.RemoveGenerator("10.0.0.1:8080"); err != nil {
+				t.Fatalf("RemoveGenerator() got error: %s", err)
+			}
+			all, err = c.AllGenerators()
+			if err != nil {
+				t.Fatalf("AllGenerators() got error: %s", err)
+			}
+			if len(all) != 1 || all[0].ID != "old" {
+				t.Errorf("AllGenerators() after RemoveGenerator() = %v, want only old", all)
+			}
+		})
+	}
+}
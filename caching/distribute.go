@@ -0,0 +1,565 @@
+package caching
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func (c Cache) calcRates(n string, cc string, count int) (string, string, error) {
+	nInt, err := strconv.Atoi(n)
+	if err != nil {
+		return "", "", errors.New("Could not get valid value for `n`: " + n)
+	}
+
+	cInt, err := strconv.Atoi(cc)
+	if err != nil {
+		return "", "", fmt.Errorf("could not get valid value for `c`: %s", cc)
+	}
+
+	nodeN := nInt / count
+	nodeC := cInt / count
+
+	// Ensures that C never exceeds N cause if that happens Apache Bench fails.
+	if nodeC > nodeN {
+		nodeC = nodeN
+	}
+	return strconv.Itoa(nodeN), strconv.Itoa(nodeC), nil
+}
+
+// split works out the share of a load request that each of count generators
+// should send.
+func (c Cache) split(req LoadRequest, count int) (LoadRequest, error) {
+	per := req
+
+	if req.Request != nil {
+		if err := req.Request.Validate(); err != nil {
+			return per, err
+		}
+	}
+
+	if len(req.Profile) > 0 {
+		if err := req.Profile.Validate(); err != nil {
+			return per, err
+		}
+		per.Profile = req.Profile.split(count)
+		per.StartAt = time.Now().Add(startLead)
+		return per, nil
+	}
+
+	if len(req.QPS) == 0 && len(req.Duration) == 0 {
+		n, con, err := c.calcRates(req.N, req.C, count)
+		if err != nil {
+			return per, err
+		}
+		per.N, per.C = n, con
+		return per, nil
+	}
+
+	d, err := time.ParseDuration(req.Duration)
+	if err != nil || d <= 0 {
+		return per, fmt.Errorf("could not get valid value for `duration`: %s", req.Duration)
+	}
+
+	// Every generator starts and stops on the same clock, so the run covers
+	// the same window on each of them no matter how fast the target answers.
+	per.StartAt = time.Now().Add(startLead)
+	per.Deadline = per.StartAt.Add(d)
+
+	if len(req.QPS) == 0 {
+		return c.splitTimed(req, per, count)
+	}
+
+	qps, err := strconv.ParseFloat(req.QPS, 64)
+	if err != nil || qps <= 0 {
+		return per, fmt.Errorf("could not get valid value for `qps`: %s", req.QPS)
+	}
+
+	per.QPS = strconv.FormatFloat(qps/float64(count), 'f', -1, 64)
+
+	// In open model runs c caps how many requests each generator can have in
+	// flight rather than driving the load.
+	if len(req.C) > 0 {
+		con, err := strconv.Atoi(req.C)
+		if err != nil {
+			return per, fmt.Errorf("could not get valid value for `c`: %s", req.C)
+		}
+		per.C = strconv.Itoa(atLeastOne(con / count))
+	}
+
+	return per, nil
+}
+
+// splitTimed shares out a closed loop run that is bounded by time. n is
+// optional, and if given stops a generator early once it has sent its share.
+func (c Cache) splitTimed(req LoadRequest, per LoadRequest, count int) (LoadRequest, error) {
+	con, err := strconv.Atoi(req.C)
+	if err != nil {
+		return per, fmt.Errorf("could not get valid value for `c`: %s", req.C)
+	}
+	per.C = strconv.Itoa(atLeastOne(con / count))
+
+	if len(req.N) > 0 {
+		n, con, err := c.calcRates(req.N, req.C, count)
+		if err != nil {
+			return per, err
+		}
+		per.N, per.C = n, con
+	}
+
+	return per, nil
+}
+
+func atLeastOne(i int) int {
+	if i < 1 {
+		return 1
+	}
+	return i
+}
+
+// startLead is how far in the future lockstep runs are scheduled to start, so
+// that every generator has the request before it is due.
+const startLead = 2 * time.Second
+
+// runGrace is how long past the end of a run bounded by time the generators
+// get to report back before the run is cancelled.
+const runGrace = time.Minute
+
+// Length returns how long a run lasts from when it is sent, including the
+// lead before the generators start, or zero for a run bounded only by n.
+func (lr LoadRequest) Length() time.Duration {
+	if len(lr.Profile) > 0 {
+		return startLead + lr.Profile.Length()
+	}
+
+	d, err := time.ParseDuration(lr.Duration)
+	if err != nil || d <= 0 {
+		return 0
+	}
+
+	return startLead + d
+}
+
+// Timeout returns how long to give a run before cancelling it, which is its
+// length and a grace period, or fallback for a run bounded only by n.
+func (lr LoadRequest) Timeout(fallback time.Duration) time.Duration {
+	if l := lr.Length(); l > 0 {
+		return l + runGrace
+	}
+	return fallback
+}
+
+// LoadRequest describes the load to spread across the generators. It is
+// either a closed loop at concurrency C of N requests, for Duration, or
+// whichever ends first, an open model of QPS requests per second for
+// Duration, or, when Profile is set, a series of stages.
+type LoadRequest struct {
+	N     string `json:"n"`
+	C     string `json:"c"`
+	URL   string `json:"url"`
+	Token string `json:"token"`
+	// QPS is the target arrival rate across every generator.
+	QPS string `json:"qps,omitempty"`
+	// Duration is how long a run lasts, like "5m". It is required with QPS.
+	Duration string `json:"duration,omitempty"`
+	// Engine picks how the generators make load, "ab" or "native". Empty
+	// leaves it up to each generator.
+	Engine string `json:"engine,omitempty"`
+	// KeepAlive has the generators reuse connections. By default every
+	// request opens a new one, as ab does.
+	KeepAlive bool `json:"keepalive,omitempty"`
+	// Profile, if set, takes the place of N, QPS and Duration.
+	Profile Profile `json:"profile,omitempty"`
+	// Request, if set, shapes the requests sent to URL. Otherwise they are
+	// plain GETs.
+	Request *RequestTemplate `json:"request,omitempty"`
+	// StartAt is when a generator should start, so that they all run in
+	// lockstep. Zero means start straight away.
+	StartAt time.Time `json:"startat,omitempty"`
+	// Job is the ID of the job the load belongs to, which generators report
+	// their progress against. It is empty for loads sent outside of a job.
+	Job string `json:"job,omitempty"`
+	// Deadline is when a generator should stop a run bounded by Duration.
+	// It is the same for every generator.
+	Deadline time.Time `json:"deadline,omitempty"`
+}
+
+// JSON Returns the given LoadRequest struct as a JSON string
+func (lr LoadRequest) JSON() (string, error) {
+
+	bytes, err := json.Marshal(lr)
+	if err != nil {
+		return "", fmt.Errorf("could not marshal json for response: %s", err)
+	}
+
+	return string(bytes), nil
+}
+
+// Load takes the content of a http request and creates a struct of it.
+func (lr *LoadRequest) Load(r io.Reader) error {
+
+	if err := json.NewDecoder(r).Decode(lr); err != nil {
+		return fmt.Errorf("could not unmarshal json for request: %s", err)
+	}
+
+	return nil
+}
+
+// Distribute splits the load request among the active load generators. Every
+// generator's outcome is collected, so one failing generator does not hide the
+// results of the others. Cancelling ctx, or letting its deadline pass, drops
+// the connection to every generator still running, which stops their load.
+// An error is only returned if the load could not be sent at all.
+func (c Cache) Distribute(ctx context.Context, req LoadRequest) (Distribution, error) {
+	list, err := c.Generators()
+	if err != nil {
+		return Distribution{Responses: ABResponses{}}, err
+	}
+
+	return c.distribute(ctx, req, list, func(ABResponse) {})
+}
+
+// distribute sends the load to the given generators, calling done with each
+// generator's response as it comes in.
+func (c Cache) distribute(ctx context.Context, req LoadRequest, list Generators, done func(ABResponse)) (Distribution, error) {
+	d := Distribution{Responses: ABResponses{}}
+
+	listlen := len(list)
+
+	if listlen == 0 {
+		return d, fmt.Errorf("there are no load nodes registered")
+	}
+
+	per, err := c.split(req, listlen)
+	if err != nil {
+		return d, err
+	}
+
+	// Buffered so that every goroutine can finish even if nobody is reading.
+	out := make(chan ABResponse, listlen)
+
+	for _, v := range list {
+
+		go func(ip string, req LoadRequest) {
+			out <- c.send(ctx, ip, req)
+		}(v.IP, per)
+
+	}
+
+	for i := 0; i < listlen; i++ {
+		resp := <-out
+		done(resp)
+		d.Responses = append(d.Responses, resp)
+	}
+
+	d.Summary = d.Responses.Summary()
+	d.Stats = d.Responses.Stats()
+
+	return d, nil
+}
+
+// send asks one generator to produce load, turning any failure into an
+// ABResponse that records what went wrong.
+func (c Cache) send(ctx context.Context, ip string, lr LoadRequest) ABResponse {
+	failed := func(status string, err error) ABResponse {
+		c.log(fmt.Sprintf("generator %s failed: %s", ip, err))
+		return ABResponse{Token: lr.Token, IP: ip, Status: status, Error: err.Error()}
+	}
+
+	body, err := lr.JSON()
+	if err != nil {
+		return failed(ABError, err)
+	}
+
+	u := fmt.Sprintf("http://%s", ip)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, strings.NewReader(body))
+	if err != nil {
+		return failed(ABError, err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	if err := c.sign(req); err != nil {
+		return failed(ABError, err)
+	}
+
+	response, err := http.DefaultClient.Do(req)
+	switch {
+	case err == nil:
+	case ctx.Err() == context.Canceled:
+		return failed(ABCancelled, ctx.Err())
+	case ctx.Err() == context.DeadlineExceeded:
+		return failed(ABTimeout, ctx.Err())
+	default:
+		if err, ok := err.(net.Error); ok && err.Timeout() {
+			return failed(ABTimeout, err)
+		}
+		return failed(ABError, err)
+	}
+	defer response.Body.Close()
+
+	resp := ABResponse{}
+	if err := resp.Load(response.Body); err != nil {
+		switch {
+		case ctx.Err() == context.Canceled:
+			return failed(ABCancelled, ctx.Err())
+		case ctx.Err() == context.DeadlineExceeded:
+			return failed(ABTimeout, ctx.Err())
+		case response.StatusCode != http.StatusOK:
+			// Errors that don't come from the generator itself, like a
+			// proxy's, aren't JSON, but the status still says what happened.
+			return failed(ABError, errors.New(response.Status))
+		}
+		return failed(ABError, err)
+	}
+
+	if response.StatusCode != http.StatusOK {
+		if len(resp.Error) == 0 {
+			resp.Error = response.Status
+		}
+		status := ABError
+		if len(resp.Status) > 0 {
+			status = resp.Status
+		}
+		// Keep whatever else the generator said, like why it rejected
+		// the target.
+		failure := failed(status, errors.New(resp.Error))
+		failure.Rejection = resp.Rejection
+		return failure
+	}
+
+	resp.IP = ip
+
+	return resp
+}
+
+// Statuses of an ABResponse.
+const (
+	ABSuccess   = "success"
+	ABError     = "error"
+	ABTimeout   = "timeout"
+	ABCancelled = "cancelled"
+	ABAborted   = "aborted"
+	// ABBusy means the generator turned the load down because it was
+	// already running, with a full queue.
+	ABBusy = "busy"
+	// ABRejected means the generator refused to send load to the target,
+	// and the response's Rejection says why.
+	ABRejected = "rejected"
+)
+
+// ABResponse is a summary of the response from Apache Bench
+type ABResponse struct {
+	Token     string
+	IP        string
+	Status    string
+	Error     string     `json:",omitempty"`
+	Rejection *Rejection `json:",omitempty"`
+	Stats     *LoadStats `json:",omitempty"`
+}
+
+// Rejection is why a generator refused to send load to a target. Rule names
+// the check that failed.
+type Rejection struct {
+	Rule   string `json:"rule"`
+	Reason string `json:"reason"`
+}
+
+// Error makes a Rejection usable as an error.
+func (r *Rejection) Error() string {
+	return fmt.Sprintf("target rejected by %s rule: %s", r.Rule, r.Reason)
+}
+
+// LoadStats are the numbers reported by a run of load.
+type LoadStats struct {
+	Complete          int     `json:"complete"`
+	Failed            int     `json:"failed"`
+	Non2xx            int     `json:"non2xx"`
+	RequestsPerSecond float64 `json:"rps"`
+	MeanLatencyMS     float64 `json:"meanlatencyms"`
+	TransferRateKBps  float64 `json:"transferratekbps"`
+	DurationSeconds   float64 `json:"durationseconds"`
+	// TargetRPS is the arrival rate that an open model run was asked for,
+	// to compare with RequestsPerSecond.
+	TargetRPS float64 `json:"targetrps,omitempty"`
+	// Late counts requests that went out behind schedule because too many
+	// were already in flight, and MaxLagMS is the furthest behind any was.
+	Late     int     `json:"late,omitempty"`
+	MaxLagMS float64 `json:"maxlagms,omitempty"`
+	// Backlog counts requests that were due but never sent before the run
+	// ended.
+	Backlog int `json:"backlog,omitempty"`
+	// Percentiles maps names like "p99" to a latency in milliseconds.
+	Percentiles map[string]float64 `json:"percentiles"`
+	// Histogram holds every latency of the run, if the engine kept them.
+	Histogram *Histogram `json:"histogram,omitempty"`
+}
+
+// JSON Returns the given ABResponse struct as a JSON string
+func (a ABResponse) JSON() (string, error) {
+
+	bytes, err := json.Marshal(a)
+	if err != nil {
+		return "", fmt.Errorf("could not marshal json for response: %s", err)
+	}
+
+	return string(bytes), nil
+}
+
+// Load takes the content of a http response and creates a struct of it.
+func (a *ABResponse) Load(r io.Reader) error {
+
+	bodyBytes, err := ioutil.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("could not read response: %s", err)
+	}
+
+	if err := json.Unmarshal(bodyBytes, &a); err != nil {
+		return fmt.Errorf("could not marshal json for response: %s", err)
+	}
+
+	return nil
+}
+
+// ABResponses is a list of ABResponses
+type ABResponses []ABResponse
+
+// JSON Returns the given ABResponse struct as a JSON string
+func (a ABResponses) JSON() (string, error) {
+
+	bytes, err := json.Marshal(a)
+	if err != nil {
+		return "", fmt.Errorf("could not marshal json for response: %s", err)
+	}
+
+	return string(bytes), nil
+}
+
+// Summary counts up the outcomes of a set of responses.
+func (a ABResponses) Summary() DistributionSummary {
+	s := DistributionSummary{Generators: len(a)}
+
+	for _, v := range a {
+		switch v.Status {
+		case ABSuccess:
+			s.Succeeded++
+		case ABTimeout:
+			s.TimedOut++
+		case ABCancelled:
+			s.Cancelled++
+		case ABAborted:
+			s.Aborted++
+		case ABRejected:
+			s.Rejected++
+		default:
+			s.Failed++
+		}
+	}
+
+	return s
+}
+
+// Stats adds up the statistics of every response that has them. Counts and
+// rates are summed since generators run side by side, and the mean latency is
+// weighted by completed requests. If every generator sent a histogram they
+// are merged and the percentiles worked out from the result. A generator with
+// no answered requests has no latencies to lose, so it counts as having sent
+// an empty histogram. Otherwise percentiles cannot be combined exactly, so the
+// worst value reported by any generator is used as an upper bound.
+func (a ABResponses) Stats() LoadStats {
+	s := LoadStats{Percentiles: map[string]float64{}}
+	latency := 0.0
+	merged := NewHistogram()
+	exact := true
+
+	for _, v := range a {
+		if v.Stats == nil {
+			continue
+		}
+
+		if v.Stats.Histogram == nil && v.Stats.Complete > v.Stats.Failed {
+			exact = false
+		}
+		merged.Merge(v.Stats.Histogram)
+
+		s.Complete += v.Stats.Complete
+		s.Failed += v.Stats.Failed
+		s.Non2xx += v.Stats.Non2xx
+		s.RequestsPerSecond += v.Stats.RequestsPerSecond
+		s.TransferRateKBps += v.Stats.TransferRateKBps
+		s.TargetRPS += v.Stats.TargetRPS
+		s.Late += v.Stats.Late
+		s.Backlog += v.Stats.Backlog
+		latency += v.Stats.MeanLatencyMS * float64(v.Stats.Complete)
+
+		if v.Stats.DurationSeconds > s.DurationSeconds {
+			s.DurationSeconds = v.Stats.DurationSeconds
+		}
+
+		if v.Stats.MaxLagMS > s.MaxLagMS {
+			s.MaxLagMS = v.Stats.MaxLagMS
+		}
+
+		for k, ms := range v.Stats.Percentiles {
+			if ms > s.Percentiles[k] {
+				s.Percentiles[k] = ms
+			}
+		}
+	}
+
+	if s.Complete > 0 {
+		s.MeanLatencyMS = latency / float64(s.Complete)
+	}
+
+	if exact && merged.Total > 0 {
+		s.Histogram = merged
+		for k := range s.Percentiles {
+			p, err := strconv.ParseFloat(strings.TrimPrefix(k, "p"), 64)
+			if err != nil {
+				continue
+			}
+			s.Percentiles[k] = float64(merged.Percentile(p)) / float64(time.Millisecond)
+		}
+	}
+
+	return s
+}
+
+// DistributionSummary is the aggregate outcome of sending load to every
+// generator.
+type DistributionSummary struct {
+	Generators int `json:"generators"`
+	Succeeded  int `json:"succeeded"`
+	Failed     int `json:"failed"`
+	TimedOut   int `json:"timedout"`
+	Cancelled  int `json:"cancelled"`
+	Aborted    int `json:"aborted"`
+	Rejected   int `json:"rejected"`
+}
+
+// Distribution is the result of splitting load across the generators, with
+// one response per generator.
+type Distribution struct {
+	Summary   DistributionSummary `json:"summary"`
+	Stats     LoadStats           `json:"stats"`
+	Responses ABResponses         `json:"responses"`
+}
+
+// JSON Returns the given Distribution struct as a JSON string
+func (d Distribution) JSON() (string, error) {
+
+	bytes, err := json.Marshal(d)
+	if err != nil {
+		return "", fmt.Errorf("could not marshal json for response: %s", err)
+	}
+
+	return string(bytes), nil
+}
@@ -0,0 +1,222 @@
+package caching
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tpryan/scaling/apitools"
+)
+
+const controlSecret = "control secret"
+
+// generator is a fake load generator that answers with a canned response.
+type generator struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	received []LoadRequest
+}
+
+func newGenerator(t *testing.T, answer func(w http.ResponseWriter, r *http.Request, lr LoadRequest)) *generator {
+	g := &generator{}
+	verifier := apitools.NewVerifier([]byte(controlSecret), apitools.DefaultMaxSkew)
+
+	g.Server = httptest.NewServer(verifier.Require(func(w http.ResponseWriter, r *http.Request) {
+		lr := LoadRequest{}
+		if err := lr.Load(r.Body); err != nil {
+			t.Errorf("generator got a bad load request: %s", err)
+		}
+
+		g.mu.Lock()
+		g.received = append(g.received, lr)
+		g.mu.Unlock()
+
+		answer(w, r, lr)
+	}))
+	t.Cleanup(g.Close)
+
+	return g
+}
+
+func (g *generator) ip() string {
+	return strings.TrimPrefix(g.URL, "http://")
+}
+
+func (g *generator) requests() []LoadRequest {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return append([]LoadRequest{}, g.received...)
+}
+
+func succeed(w http.ResponseWriter, r *http.Request, lr LoadRequest) {
+	n, _ := strconv.Atoi(lr.N)
+	h := NewHistogram()
+	for i := 0; i < n; i++ {
+		h.Record(20 * time.Millisecond)
+	}
+
+	resp := ABResponse{Token: lr.Token, Status: ABSuccess, Stats: &LoadStats{Complete: n, RequestsPerSecond: 50, MeanLatencyMS: 20, Percentiles: Percentiles{"p99": 20}, Histogram: h}}
+	j, _ := resp.JSON()
+	apitools.Respond(w, http.StatusOK, j)
+}
+
+func badGateway(w http.ResponseWriter, r *http.Request, lr LoadRequest) {
+	// A proxy in front of the generator answers in plain text.
+	http.Error(w, "upstream connect error", http.StatusBadGateway)
+}
+
+func reject(w http.ResponseWriter, r *http.Request, lr LoadRequest) {
+	resp := ABResponse{Token: lr.Token, Status: ABRejected, Error: "not allowed", Rejection: &Rejection{Rule: "allow", Reason: "not allowed"}}
+	j, _ := resp.JSON()
+	apitools.Respond(w, http.StatusForbidden, j)
+}
+
+func hang(w http.ResponseWriter, r *http.Request, lr LoadRequest) {
+	<-r.Context().Done()
+}
+
+func TestDistribute(t *testing.T) {
+	c := newTestCache(t)
+	c.SetControlSecret(controlSecret)
+
+	gens := map[string]*generator{
+		"ok":       newGenerator(t, succeed),
+		"502":      newGenerator(t, badGateway),
+		"rejected": newGenerator(t, reject),
+		"hanging":  newGenerator(t, hang),
+	}
+	for name, g := range gens {
+		if err := c.RegisterGenerator(name, g.ip(), false); err != nil {
+			t.Fatalf("RegisterGenerator() got error: %s", err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	d, err := c.Distribute(ctx, LoadRequest{N: "400", C: "40", URL: "http://receiver/record", Token: "tok"})
+	if err != nil {
+		t.Fatalf("Distribute() got error: %s", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Distribute() took %s, want the hanging generator cut off at the deadline", elapsed)
+	}
+
+	// Every generator gets its share of the load.
+	for name, g := range gens {
+		got := g.requests()
+		if len(got) != 1 {
+			t.Fatalf("generator %s got %d requests, want 1", name, len(got))
+		}
+		if got[0].N != "100" || got[0].C != "10" || got[0].Token != "tok" {
+			t.Errorf("generator %s got n=%s c=%s token=%s, want 100, 10, tok", name, got[0].N, got[0].C, got[0].Token)
+		}
+	}
+
+	responses := map[string]ABResponse{}
+	for _, r := range d.Responses {
+		responses[r.IP] = r
+	}
+
+	cases := []struct {
+		name   string
+		status string
+		err    string
+	}{
+		{"ok", ABSuccess, ""},
+		{"502", ABError, "502 Bad Gateway"},
+		{"rejected", ABRejected, "not allowed"},
+		{"hanging", ABTimeout, context.DeadlineExceeded.Error()},
+	}
+	for _, tc := range cases {
+		r, ok := responses[gens[tc.name].ip()]
+		if !ok {
+			t.Errorf("no response from generator %s", tc.name)
+			continue
+		}
+		if r.Status != tc.status || r.Error != tc.err {
+			t.Errorf("generator %s got %s (%q), want %s (%q)", tc.name, r.Status, r.Error, tc.status, tc.err)
+		}
+		if r.Token != "tok" {
+			t.Errorf("generator %s response token = %q, want tok", tc.name, r.Token)
+		}
+	}
+
+	if r := responses[gens["rejected"].ip()]; r.Rejection == nil || r.Rejection.Rule != "allow" {
+		t.Errorf("rejected generator's response lost why: %+v", r.Rejection)
+	}
+
+	want := DistributionSummary{Generators: 4, Succeeded: 1, Failed: 1, TimedOut: 1, Rejected: 1}
+	if d.Summary != want {
+		t.Errorf("Distribute() summary = %+v, want %+v", d.Summary, want)
+	}
+
+	if d.Stats.Complete != 100 {
+		t.Errorf("Distribute() stats complete = %d, want only the successful generator's 100", d.Stats.Complete)
+	}
+	if d.Stats.Histogram == nil || d.Stats.Histogram.Total != 100 {
+		t.Errorf("Distribute() histogram = %+v, want the successful generator's", d.Stats.Histogram)
+	}
+	if p99 := d.Stats.Percentiles["p99"]; p99 < 20 || p99 > 21 {
+		t.Errorf("Distribute() p99 = %v, want it from the merged histogram", p99)
+	}
+}
+
+func TestDistributeCancelled(t *testing.T) {
+	c := newTestCache(t)
+	c.SetControlSecret(controlSecret)
+
+	g := newGenerator(t, hang)
+	if err := c.RegisterGenerator("hanging", g.ip(), false); err != nil {
+		t.Fatalf("RegisterGenerator() got error: %s", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+
+	d, err := c.Distribute(ctx, LoadRequest{N: "10", C: "1", URL: "http://receiver/record"})
+	if err != nil {
+		t.Fatalf("Distribute() got error: %s", err)
+	}
+
+	if len(d.Responses) != 1 || d.Responses[0].Status != ABCancelled {
+		t.Errorf("Distribute() got %+v, want the generator cancelled", d.Responses)
+	}
+	if d.Summary.Cancelled != 1 {
+		t.Errorf("Distribute() summary = %+v, want one cancelled", d.Summary)
+	}
+}
+
+func TestDistributeUnsigned(t *testing.T) {
+	c := newTestCache(t)
+
+	g := newGenerator(t, succeed)
+	if err := c.RegisterGenerator("ok", g.ip(), false); err != nil {
+		t.Fatalf("RegisterGenerator() got error: %s", err)
+	}
+
+	d, err := c.Distribute(context.Background(), LoadRequest{N: "10", C: "1", URL: "http://receiver/record"})
+	if err != nil {
+		t.Fatalf("Distribute() got error: %s", err)
+	}
+
+	// The generator's 401 isn't from a run, but it still has to say why.
+	if d.Responses[0].Status != ABError || !strings.Contains(d.Responses[0].Error, "not signed") {
+		t.Errorf("Distribute() without the secret got %s (%q), want the generator's refusal", d.Responses[0].Status, d.Responses[0].Error)
+	}
+}
+
+func TestDistributeNoGenerators(t *testing.T) {
+	c := newTestCache(t)
+
+	if _, err := c.Distribute(context.Background(), LoadRequest{N: "10", C: "1"}); err == nil {
+		t.Errorf("Distribute() with no generators got no error")
+	}
+}
@@ -0,0 +1,121 @@
+package caching
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ReceiverHealth is the outcome of the latest probe of a receiver's health
+// endpoint.
+type ReceiverHealth struct {
+	Up          bool      `json:"up"`
+	LatencyMS   int64     `json:"latencyms"`
+	LastChecked time.Time `json:"lastchecked"`
+	LastSuccess time.Time `json:"lastsuccess"`
+	Error       string    `json:"error,omitempty"`
+}
+
+// JSON Returns the given ReceiverHealth struct as a JSON string
+func (h ReceiverHealth) JSON() (string, error) {
+
+	bytes, err := json.Marshal(h)
+	if err != nil {
+		return "", fmt.Errorf("could not marshal json for response: %s", err)
+	}
+
+	return string(bytes), nil
+}
+
+// Load populates a structure with data from json.
+func (h *ReceiverHealth) Load(j string) error {
+
+	if err := json.Unmarshal([]byte(j), h); err != nil {
+		return err
+	}
+	return nil
+}
+
+// HealthURL works out the health check url of a receiver from the endpoint
+// that load is sent to, unless the receiver registered one.
+func (r Receiver) HealthURL() (string, error) {
+	if len(r.HealthEndpoint) > 0 {
+		return strings.TrimSpace(r.HealthEndpoint), nil
+	}
+
+	u, err := url.Parse(strings.TrimSpace(r.Endpoint))
+	if err != nil {
+		return "", err
+	}
+
+	u.Path = strings.TrimSuffix(u.Path, "/record") + "/healthz"
+	u.RawQuery = ""
+
+	return u.String(), nil
+}
+
+// ProbeReceivers checks the health endpoint of every registered receiver at
+// the same time and records the latency and outcome of each.
+func (c Cache) ProbeReceivers(client *http.Client) error {
+	list, err := c.Receivers()
+	if err != nil {
+		return err
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(list))
+
+	for _, v := range list {
+		wg.Add(1)
+		go func(r Receiver) {
+			defer wg.Done()
+
+			h := probe(client, r)
+			if err := c.storage.RecordReceiverHealth(r.Endpoint, h); err != nil {
+				errs <- err
+			}
+		}(v)
+	}
+
+	wg.Wait()
+	close(errs)
+
+	return <-errs
+}
+
+// probe makes one health check against a receiver, carrying forward the last
+// success from the previous probe when this one fails.
+func probe(client *http.Client, r Receiver) ReceiverHealth {
+	h := ReceiverHealth{LastChecked: time.Now()}
+	if r.Health != nil {
+		h.LastSuccess = r.Health.LastSuccess
+	}
+
+	u, err := r.HealthURL()
+	if err != nil {
+		h.Error = err.Error()
+		return h
+	}
+
+	response, err := client.Get(u)
+	h.LatencyMS = time.Since(h.LastChecked).Milliseconds()
+	if err != nil {
+		h.Error = err.Error()
+		return h
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		h.Error = fmt.Sprintf("health check returned %s", response.Status)
+		return h
+	}
+
+	h.Up = true
+	h.LastSuccess = h.LastChecked
+
+	return h
+}
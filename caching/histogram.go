@@ -0,0 +1,182 @@
+package caching
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/bits"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// subBucketBits sets the precision of a Histogram. Every power of two range
+// is split into 64 buckets, so any recorded value is within about 1.6% of the
+// value reported for it.
+const subBucketBits = 7
+
+// Histogram counts latencies in log-linear buckets, in the style of HDR
+// histograms. Unlike percentiles, histograms from different generators can
+// be merged exactly, so percentiles of the merged one hold for the whole run.
+// Values are kept in microseconds, and only buckets with counts are stored.
+type Histogram struct {
+	Counts map[int]int64 `json:"counts"`
+	Total  int64         `json:"total"`
+	MinUS  int64         `json:"minus"`
+	MaxUS  int64         `json:"maxus"`
+}
+
+// NewHistogram returns an empty histogram.
+func NewHistogram() *Histogram {
+	return &Histogram{Counts: map[int]int64{}}
+}
+
+// bucket returns the index of the bucket that holds v.
+func bucket(v int64) int {
+	if v < 1<<subBucketBits {
+		return int(v)
+	}
+
+	shift := bits.Len64(uint64(v)) - subBucketBits
+	half := 1 << (subBucketBits - 1)
+
+	return shift*half + int(v>>uint(shift))
+}
+
+// highest returns the largest value that falls in a bucket.
+func highest(index int) int64 {
+	if index < 1<<subBucketBits {
+		return int64(index)
+	}
+
+	half := 1 << (subBucketBits - 1)
+	shift := index/half - 1
+	mantissa := int64(index - shift*half)
+
+	return (mantissa+1)<<uint(shift) - 1
+}
+
+// Record counts one latency.
+func (h *Histogram) Record(d time.Duration) {
+	v := d.Microseconds()
+	if v < 0 {
+		v = 0
+	}
+
+	if h.Counts == nil {
+		h.Counts = map[int]int64{}
+	}
+
+	if h.Total == 0 || v < h.MinUS {
+		h.MinUS = v
+	}
+	if v > h.MaxUS {
+		h.MaxUS = v
+	}
+
+	h.Counts[bucket(v)]++
+	h.Total++
+}
+
+// Merge adds the counts of another histogram to this one.
+func (h *Histogram) Merge(o *Histogram) {
+	if o == nil || o.Total == 0 {
+		return
+	}
+
+	if h.Counts == nil {
+		h.Counts = map[int]int64{}
+	}
+
+	if h.Total == 0 || o.MinUS < h.MinUS {
+		h.MinUS = o.MinUS
+	}
+	if o.MaxUS > h.MaxUS {
+		h.MaxUS = o.MaxUS
+	}
+
+	for k, v := range o.Counts {
+		h.Counts[k] += v
+	}
+	h.Total += o.Total
+}
+
+// Percentile returns the latency that p percent of the recorded values are
+// at or under, like 99.9 for p99.9. The value is the top of its bucket, so it
+// errs on the side of being slow.
+func (h *Histogram) Percentile(p float64) time.Duration {
+	if h.Total == 0 {
+		return 0
+	}
+
+	if p <= 0 {
+		return time.Duration(h.MinUS) * time.Microsecond
+	}
+
+	rank := int64(p/100*float64(h.Total) + 0.5)
+	if rank < 1 {
+		rank = 1
+	}
+
+	indexes := []int{}
+	for k := range h.Counts {
+		indexes = append(indexes, k)
+	}
+	sort.Ints(indexes)
+
+	seen := int64(0)
+	for _, k := range indexes {
+		seen += h.Counts[k]
+		if seen >= rank {
+			v := highest(k)
+			if v > h.MaxUS {
+				v = h.MaxUS
+			}
+			return time.Duration(v) * time.Microsecond
+		}
+	}
+
+	return time.Duration(h.MaxUS) * time.Microsecond
+}
+
+// Each calls fn with the top of every bucket that has counts, in order, and
+// how many latencies fell in it.
+func (h *Histogram) Each(fn func(d time.Duration, count int64)) {
+	indexes := []int{}
+	for k := range h.Counts {
+		indexes = append(indexes, k)
+	}
+	sort.Ints(indexes)
+
+	for _, k := range indexes {
+		v := highest(k)
+		if v > h.MaxUS {
+			v = h.MaxUS
+		}
+		fn(time.Duration(v)*time.Microsecond, h.Counts[k])
+	}
+}
+
+// Percentiles returns the given percentiles in milliseconds, keyed by names
+// like "p99.9".
+func (h *Histogram) Percentiles(ps []float64) Percentiles {
+	out := Percentiles{}
+	for _, p := range ps {
+		name := "p" + strconv.FormatFloat(p, 'f', -1, 64)
+		out[name] = float64(h.Percentile(p)) / float64(time.Millisecond)
+	}
+	return out
+}
+
+// Percentiles maps names like "p99" to a latency in milliseconds.
+type Percentiles map[string]float64
+
+// JSON Returns the given Percentiles map as a JSON string
+func (p Percentiles) JSON() (string, error) {
+
+	bytes, err := json.Marshal(p)
+	if err != nil {
+		return "", fmt.Errorf("could not marshal json for response: %s", err)
+	}
+
+	return string(bytes), nil
+}
@@ -0,0 +1,114 @@
+package caching
+
+import (
+	"math/rand"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestBucketRoundTrip(t *testing.T) {
+	values := []int64{0, 1, 63, 127, 128, 129, 255, 256, 1000, 4096, 123456, 1 << 20, 1<<40 + 12345}
+
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 1000; i++ {
+		values = append(values, r.Int63n(1<<36))
+	}
+
+	for _, v := range values {
+		i := bucket(v)
+		top := highest(i)
+
+		if top < v {
+			t.Errorf("highest(bucket(%d)) = %d, want at least %d", v, top, v)
+		}
+		if bucket(top) != i {
+			t.Errorf("bucket(highest(%d)) = %d, want %d", i, bucket(top), i)
+		}
+		if i > 0 && highest(i-1) >= v {
+			t.Errorf("%d falls in bucket %d, but bucket %d already reaches %d", v, i, i-1, highest(i-1))
+		}
+		if err := float64(top-v) / float64(v+1); err > 1.0/64 {
+			t.Errorf("%d is reported as %d, off by %.3f%%", v, top, err*100)
+		}
+	}
+}
+
+func TestMergedPercentiles(t *testing.T) {
+	r := rand.New(rand.NewSource(2))
+
+	all := []time.Duration{}
+	parts := []*Histogram{NewHistogram(), NewHistogram(), NewHistogram()}
+
+	for i, h := range parts {
+		// Each generator sees a different spread of latencies.
+		for j := 0; j < 5000; j++ {
+			d := time.Duration(r.ExpFloat64()*float64((i+1)*20)*float64(time.Millisecond)) + time.Millisecond
+			d = d.Truncate(time.Microsecond)
+			h.Record(d)
+			all = append(all, d)
+		}
+	}
+
+	merged := NewHistogram()
+	for _, h := range parts {
+		merged.Merge(h)
+	}
+	merged.Merge(nil)
+	merged.Merge(NewHistogram())
+
+	if merged.Total != int64(len(all)) {
+		t.Fatalf("merged total = %d, want %d", merged.Total, len(all))
+	}
+
+	sort.Slice(all, func(i, j int) bool { return all[i] < all[j] })
+
+	for _, p := range []float64{50, 90, 99, 99.9, 100} {
+		rank := int(p/100*float64(len(all)) + 0.5)
+		if rank < 1 {
+			rank = 1
+		}
+		exact := all[rank-1]
+		got := merged.Percentile(p)
+
+		if got < exact || float64(got-exact) > float64(exact)/64 {
+			t.Errorf("p%v = %s, want %s within 1/64", p, got, exact)
+		}
+	}
+
+	if merged.Percentile(0) != all[0] {
+		t.Errorf("p0 = %s, want the minimum %s", merged.Percentile(0), all[0])
+	}
+}
+
+func TestStatsMergesWithEmptyGenerator(t *testing.T) {
+	h := NewHistogram()
+	for i := 1; i <= 100; i++ {
+		h.Record(time.Duration(i) * time.Millisecond)
+	}
+
+	responses := ABResponses{
+		{Status: ABSuccess, Stats: &LoadStats{Complete: 100, Percentiles: map[string]float64{"p50": 50}, Histogram: h}},
+		// Every request failed, so there were no latencies to send.
+		{Status: ABSuccess, Stats: &LoadStats{Complete: 10, Failed: 10, Percentiles: map[string]float64{"p50": 0}}},
+	}
+
+	s := responses.Stats()
+	if s.Histogram == nil {
+		t.Fatalf("merge was not exact")
+	}
+	if s.Histogram.Total != 100 {
+		t.Errorf("merged total = %d, want 100", s.Histogram.Total)
+	}
+
+	// A generator that answered requests but sent no histogram still stops
+	// the merge.
+	responses = append(responses, ABResponse{Status: ABSuccess, Stats: &LoadStats{Complete: 10, Percentiles: map[string]float64{"p50": 80}}})
+	s = responses.Stats()
+	if s.Histogram != nil {
+		t.Errorf("merge was exact with a generator missing latencies")
+	}
+	if s.Percentiles["p50"] != 80 {
+		t.Errorf("p50 = %v, want the worst reported 80", s.Percentiles["p50"])
+	}
+}
@@ -0,0 +1,345 @@
+package caching
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Statuses of a Job.
+const (
+	JobRunning  = "running"
+	JobComplete = "complete"
+	JobFailed   = "failed"
+	JobAborted  = "aborted"
+)
+
+// jobTTL is how long a job is kept after it was last updated. Finished jobs
+// carry the result of every generator, so they can't be kept forever.
+const jobTTL = 7 * 24 * time.Hour
+
+// running holds a way to cancel every job distributed by this process, so
+// that AbortJob can stop them.
+var running = struct {
+	sync.Mutex
+	cancels map[string]context.CancelFunc
+}{cancels: map[string]context.CancelFunc{}}
+
+// Job is a record of a load request that is distributed in the background.
+type Job struct {
+	ID         string                       `json:"id"`
+	Status     string                       `json:"status"`
+	Request    LoadRequest                  `json:"request"`
+	Created    time.Time                    `json:"created"`
+	Finished   time.Time                    `json:"finished"`
+	Generators map[string]GeneratorProgress `json:"generators"`
+	Result     *Distribution                `json:"result,omitempty"`
+	Error      string                       `json:"error,omitempty"`
+}
+
+// GeneratorProgress is how far along one generator is with a job, keyed in
+// the job by the generator's IP.
+type GeneratorProgress struct {
+	ID      string    `json:"id"`
+	IP      string    `json:"ip"`
+	Status  string    `json:"status"`
+	Updated time.Time `json:"updated"`
+	Error   string    `json:"error,omitempty"`
+}
+
+// JSON Returns the given Job struct as a JSON string
+func (j Job) JSON() (string, error) {
+
+	bytes, err := json.Marshal(j)
+	if err != nil {
+		return "", fmt.Errorf("could not marshal json for response: %s", err)
+	}
+
+	return string(bytes), nil
+}
+
+// Load populates a structure with data from json.
+func (j *Job) Load(s string) error {
+
+	if err := json.Unmarshal([]byte(s), j); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Summary returns the job without its result, which is too heavy to list.
+// The whole job can be fetched by ID.
+func (j Job) Summary() Job {
+	j.Result = nil
+	return j
+}
+
+// expired reports whether a job has outlived jobTTL.
+func (j Job) expired(now time.Time) bool {
+	last := j.Created
+	if j.Finished.After(last) {
+		last = j.Finished
+	}
+	return now.Sub(last) > jobTTL
+}
+
+// Jobs is a slice of Jobs
+type Jobs []Job
+
+// JSON Returns the given Jobs slice as a JSON string
+func (j Jobs) JSON() (string, error) {
+
+	bytes, err := json.Marshal(j)
+	if err != nil {
+		return "", fmt.Errorf("could not marshal json for response: %s", err)
+	}
+
+	return string(bytes), nil
+}
+
+// StartJob records a new job for the load request and distributes it in the
+// background, returning as soon as the job has been recorded. The job is
+// cancelled if it is still running when the timeout passes.
+func (c Cache) StartJob(req LoadRequest, timeout time.Duration) (Job, error) {
+	job := Job{}
+
+	list, err := c.Generators()
+	if err != nil {
+		return job, err
+	}
+
+	if len(list) == 0 {
+		return job, fmt.Errorf("there are no load nodes registered")
+	}
+
+	if _, err := c.split(req, len(list)); err != nil {
+		return job, err
+	}
+
+	id, err := CreateID()
+	if err != nil {
+		return job, err
+	}
+
+	now := time.Now()
+	job = Job{
+		ID:         id,
+		Status:     JobRunning,
+		Request:    req,
+		Created:    now,
+		Generators: map[string]GeneratorProgress{},
+	}
+
+	for _, v := range list {
+		job.Generators[v.IP] = GeneratorProgress{ID: v.ID, IP: v.IP, Status: JobRunning, Updated: now}
+	}
+
+	if err := c.storage.SaveJob(job); err != nil {
+		return job, err
+	}
+
+	go c.runJob(job, list, timeout)
+
+	return job, nil
+}
+
+// runJob distributes the load of a job, saving the job every time a
+// generator finishes.
+func (c Cache) runJob(job Job, list Generators, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	running.Lock()
+	running.cancels[job.ID] = cancel
+	running.Unlock()
+
+	defer func() {
+		running.Lock()
+		delete(running.cancels, job.ID)
+		running.Unlock()
+	}()
+
+	req := job.Request
+	req.Job = job.ID
+
+	d, err := c.distribute(ctx, req, list, func(resp ABResponse) {
+		p := job.Generators[resp.IP]
+		p.Status = resp.Status
+		p.Error = resp.Error
+		p.Updated = time.Now()
+		job.Generators[resp.IP] = p
+
+		c.saveJob(&job)
+	})
+
+	job.Finished = time.Now()
+	job.Status = JobComplete
+	job.Result = &d
+
+	switch {
+	case err != nil:
+		job.Status = JobFailed
+		job.Error = err.Error()
+	case ctx.Err() == context.DeadlineExceeded:
+		job.Status = JobFailed
+		job.Error = fmt.Sprintf("timed out after %s", timeout)
+	case ctx.Err() != nil:
+		job.Status = JobFailed
+		job.Error = fmt.Sprintf("cancelled: %s", ctx.Err())
+	case d.Summary.Succeeded == 0:
+		job.Status = JobFailed
+		job.Error = fmt.Sprintf("none of the %d generators succeeded", d.Summary.Generators)
+	}
+
+	c.saveJob(&job)
+}
+
+// saveJob saves a running job, taking care not to undo an abort that was
+// recorded while it ran. The check and the write happen in one step in
+// storage, so an abort can't land between them.
+func (c Cache) saveJob(job *Job) {
+	saved, err := c.storage.UpdateJob(*job)
+	if err != nil {
+		c.log(fmt.Sprintf("could not save job %s: %s", job.ID, err))
+		return
+	}
+
+	job.Status = saved.Status
+	job.Finished = saved.Finished
+	job.Error = saved.Error
+}
+
+// keepAbort copies an abort from the stored version of a job onto a newer
+// version, which storage then writes in its place.
+func keepAbort(stored Job, job Job) Job {
+	if stored.Status == JobAborted {
+		job.Status = JobAborted
+		job.Finished = stored.Finished
+		job.Error = stored.Error
+	}
+	return job
+}
+
+// AbortJob stops a running job. Every generator still working on it is told
+// to stop its load and marked inactive, and the job is marked aborted. If the
+// job was started by this process its distribution is cancelled as well.
+func (c Cache) AbortJob(id string, client *http.Client) (Job, error) {
+	job, err := c.storage.Job(id)
+	if err != nil {
+		return job, err
+	}
+
+	if job.Status != JobRunning {
+		return job, fmt.Errorf("job %s is not running, it is %s", id, job.Status)
+	}
+
+	job.Status = JobAborted
+	job.Finished = time.Now()
+	job.Error = "aborted"
+	if err := c.storage.SaveJob(job); err != nil {
+		return job, err
+	}
+
+	list, err := c.storage.Generators()
+	if err != nil {
+		return job, err
+	}
+
+	var wg sync.WaitGroup
+	for _, g := range list {
+		p, ok := job.Generators[g.IP]
+		if !ok || p.Status != JobRunning {
+			continue
+		}
+
+		wg.Add(1)
+		go func(g Generator) {
+			defer wg.Done()
+
+			if err := c.abortGenerator(client, g.IP, id); err != nil {
+				c.log(fmt.Sprintf("could not abort generator %s: %s", g.IP, err))
+			}
+
+			g.Active = false
+			if err := c.storage.RegisterGenerator(g); err != nil {
+				c.log(fmt.Sprintf("could not mark generator %s inactive: %s", g.IP, err))
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	running.Lock()
+	if cancel, ok := running.cancels[id]; ok {
+		cancel()
+	}
+	running.Unlock()
+
+	return job, nil
+}
+
+// AbortRunning aborts every job this process is distributing, for when it is
+// shutting down and can't see them through.
+func (c Cache) AbortRunning(client *http.Client) {
+	running.Lock()
+	ids := []string{}
+	for id := range running.cancels {
+		ids = append(ids, id)
+	}
+	running.Unlock()
+
+	for _, id := range ids {
+		if _, err := c.AbortJob(id, client); err != nil {
+			c.log(fmt.Sprintf("could not abort job %s: %s", id, err))
+		}
+	}
+}
+
+// abortGenerator asks a generator to stop the load it is sending for a job.
+func (c Cache) abortGenerator(client *http.Client, ip, job string) error {
+	u := fmt.Sprintf("http://%s/abort?job=%s", ip, url.QueryEscape(job))
+
+	req, err := http.NewRequest(http.MethodPost, u, nil)
+	if err != nil {
+		return err
+	}
+
+	if err := c.sign(req); err != nil {
+		return err
+	}
+
+	response, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("generator responded %s", response.Status)
+	}
+
+	return nil
+}
+
+// Job returns a job by its ID.
+func (c Cache) Job(id string) (Job, error) {
+	return c.storage.Job(id)
+}
+
+// Jobs returns every job, most recent first.
+func (c Cache) Jobs() (Jobs, error) {
+	jobs, err := c.storage.Jobs()
+	if err != nil {
+		return jobs, err
+	}
+
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].Created.After(jobs[j].Created)
+	})
+
+	return jobs, nil
+}
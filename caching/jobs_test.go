@@ -0,0 +1,88 @@
+package caching
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSaveJobKeepsAbort(t *testing.T) {
+	c := newTestCache(t)
+
+	job := Job{ID: "job", Status: JobRunning, Created: time.Now(), Generators: map[string]GeneratorProgress{}}
+	if err := c.storage.SaveJob(job); err != nil {
+		t.Fatalf("SaveJob() got error: %s", err)
+	}
+
+	// The job is aborted while the distribution is still going.
+	aborted := job
+	aborted.Status = JobAborted
+	aborted.Finished = time.Now()
+	aborted.Error = "aborted by request"
+	if err := c.storage.SaveJob(aborted); err != nil {
+		t.Fatalf("SaveJob() got error: %s", err)
+	}
+
+	job.Status = JobComplete
+	job.Finished = time.Now().Add(time.Second)
+	job.Result = &Distribution{Summary: DistributionSummary{Generators: 1, Succeeded: 1}}
+	c.saveJob(&job)
+
+	if job.Status != JobAborted || job.Error != aborted.Error || !job.Finished.Equal(aborted.Finished) {
+		t.Errorf("saveJob() left the job %s (%q), want it aborted", job.Status, job.Error)
+	}
+
+	stored, err := c.Job("job")
+	if err != nil {
+		t.Fatalf("Job() got error: %s", err)
+	}
+	if stored.Status != JobAborted {
+		t.Errorf("Job() status = %s, want %s", stored.Status, JobAborted)
+	}
+	if stored.Result == nil {
+		t.Errorf("Job() lost the result that was saved with the abort")
+	}
+}
+
+func TestJobs(t *testing.T) {
+	c := newTestCache(t)
+
+	now := time.Now()
+	jobs := []Job{
+		{ID: "new", Status: JobComplete, Created: now, Finished: now, Result: &Distribution{}},
+		{ID: "finished-late", Status: JobComplete, Created: now.Add(-2 * jobTTL), Finished: now.Add(-time.Hour), Result: &Distribution{}},
+		{ID: "old", Status: JobComplete, Created: now.Add(-2 * jobTTL), Finished: now.Add(-jobTTL - time.Hour), Result: &Distribution{}},
+	}
+	for _, job := range jobs {
+		if err := c.storage.SaveJob(job); err != nil {
+			t.Fatalf("SaveJob() got error: %s", err)
+		}
+	}
+
+	if _, err := c.Job("old"); err != ErrCacheMiss {
+		t.Errorf("Job() of an expired job got error %v, want %s", err, ErrCacheMiss)
+	}
+
+	job, err := c.Job("new")
+	if err != nil {
+		t.Fatalf("Job() got error: %s", err)
+	}
+	if job.Result == nil {
+		t.Errorf("Job() dropped the result")
+	}
+
+	list, err := c.Jobs()
+	if err != nil {
+		t.Fatalf("Jobs() got error: %s", err)
+	}
+	if len(list) != 2 {
+		t.Fatalf("Jobs() got %d jobs, want 2", len(list))
+	}
+	if list[0].ID != "new" || list[1].ID != "finished-late" {
+		t.Errorf("Jobs() = %s, %s, want newest first", list[0].ID, list[1].ID)
+	}
+	for _, j := range list {
+		if j.Result != nil {
+			t.Errorf("Jobs() listed %s with its result", j.ID)
+		}
+	}
+}
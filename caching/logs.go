@@ -0,0 +1,94 @@
+package caching
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Limits on the run logs kept in the cache. ab's verbose output can run to
+// many megabytes, and the end of it, which has the summary, matters most.
+const (
+	maxLogSize = 4 * 1024 * 1024
+	logTTL     = 7 * 24 * time.Hour
+)
+
+// RunLog describes the output a generator kept from one run. The output
+// itself is fetched separately with Log.
+type RunLog struct {
+	Token     string    `json:"token"`
+	Generator string    `json:"generator"`
+	Created   time.Time `json:"created"`
+	Size      int       `json:"size"`
+	Truncated bool      `json:"truncated"`
+}
+
+// JSON Returns the given RunLog struct as a JSON string
+func (l RunLog) JSON() (string, error) {
+
+	bytes, err := json.Marshal(l)
+	if err != nil {
+		return "", fmt.Errorf("could not marshal json for response: %s", err)
+	}
+
+	return string(bytes), nil
+}
+
+// Load populates a structure with data from json.
+func (l *RunLog) Load(s string) error {
+
+	if err := json.Unmarshal([]byte(s), l); err != nil {
+		return err
+	}
+	return nil
+}
+
+// RunLogs is a slice of RunLogs
+type RunLogs []RunLog
+
+// JSON Returns the given RunLogs slice as a JSON string
+func (l RunLogs) JSON() (string, error) {
+
+	bytes, err := json.Marshal(l)
+	if err != nil {
+		return "", fmt.Errorf("could not marshal json for response: %s", err)
+	}
+
+	return string(bytes), nil
+}
+
+// SaveLog keeps the output of a run, keyed by its token and the generator
+// that ran it. Output over the size limit loses its beginning. It makes the
+// cache a sink for generator logs.
+func (c Cache) SaveLog(token, generator string, data []byte) error {
+	l := RunLog{Token: token, Generator: generator, Created: time.Now()}
+
+	if len(data) > maxLogSize {
+		data = data[len(data)-maxLogSize:]
+		l.Truncated = true
+	}
+	l.Size = len(data)
+
+	return c.storage.SaveLog(l, data)
+}
+
+// Logs lists the logs kept for a token, one per generator.
+func (c Cache) Logs(token string) (RunLogs, error) {
+	logs, err := c.storage.Logs(token)
+	if err != nil {
+		return logs, err
+	}
+
+	sort.Slice(logs, func(i, j int) bool {
+		return logs[i].Generator < logs[j].Generator
+	})
+
+	return logs, nil
+}
+
+// Log returns the output a generator kept for a token, or ErrCacheMiss if
+// there is none.
+func (c Cache) Log(token, generator string) ([]byte, error) {
+	return c.storage.Log(token, generator)
+}
@@ -0,0 +1,56 @@
+package caching
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestLogs(t *testing.T) {
+	c := newTestCache(t)
+
+	big := bytes.Repeat([]byte("x"), maxLogSize)
+	big = append([]byte("head"), big...)
+	big = append(big, []byte("summary")...)
+
+	if err := c.SaveLog("token", "gen-b", big); err != nil {
+		t.Fatalf("SaveLog() got error: %s", err)
+	}
+	if err := c.SaveLog("token", "gen-a", []byte("short")); err != nil {
+		t.Fatalf("SaveLog() got error: %s", err)
+	}
+	if err := c.SaveLog("other", "gen-a", []byte("other")); err != nil {
+		t.Fatalf("SaveLog() got error: %s", err)
+	}
+
+	logs, err := c.Logs("token")
+	if err != nil {
+		t.Fatalf("Logs() got error: %s", err)
+	}
+	if len(logs) != 2 {
+		t.Fatalf("Logs() got %d logs, want 2", len(logs))
+	}
+	if logs[0].Generator != "gen-a" || logs[1].Generator != "gen-b" {
+		t.Errorf("Logs() = %s, %s, want them sorted by generator", logs[0].Generator, logs[1].Generator)
+	}
+	if logs[0].Truncated || logs[0].Size != len("short") {
+		t.Errorf("Logs() short log = %+v, want it whole", logs[0])
+	}
+	if !logs[1].Truncated || logs[1].Size != maxLogSize {
+		t.Errorf("Logs() big log = %+v, want it truncated to %d", logs[1], maxLogSize)
+	}
+
+	data, err := c.Log("token", "gen-b")
+	if err != nil {
+		t.Fatalf("Log() got error: %s", err)
+	}
+	if len(data) != maxLogSize {
+		t.Errorf("Log() got %d bytes, want %d", len(data), maxLogSize)
+	}
+	if !bytes.HasSuffix(data, []byte("summary")) || bytes.HasPrefix(data, []byte("head")) {
+		t.Errorf("Log() kept the wrong end of the output")
+	}
+
+	if _, err := c.Log("token", "gen-c"); err != ErrCacheMiss {
+		t.Errorf("Log() of a missing log got error %v, want %s", err, ErrCacheMiss)
+	}
+}
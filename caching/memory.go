@@ -0,0 +1,410 @@
+package caching
+
+import (
+	"sync"
+	"time"
+)
+
+// memoryStorage is the Storage implementation that keeps everything in
+// process memory. It is meant for tests, since only code in the same
+// process can see what it holds.
+type memoryStorage struct {
+	mu         sync.Mutex
+	runs       map[string]Run
+	runData    map[string]*memoryRun
+	currentrun string
+	loadnodes  map[string]Generator
+	receivers  map[string]Receiver
+	health     map[string]ReceiverHealth
+	jobs       map[string]Job
+	progress   map[string]map[string]Progress
+	logs       map[string]map[string]RunLog
+	logData    map[string][]byte
+}
+
+// memoryRun holds the hits recorded against a single run.
+type memoryRun struct {
+	index     map[string]Instance
+	series    map[string]map[int64]int
+	envSeries map[string]map[int64]int
+}
+
+func newMemoryStorage() *memoryStorage {
+	s := &memoryStorage{}
+	s.runs = map[string]Run{}
+	s.runData = map[string]*memoryRun{}
+	s.loadnodes = map[string]Generator{}
+	s.receivers = map[string]Receiver{}
+	s.health = map[string]ReceiverHealth{}
+	s.jobs = map[string]Job{}
+	s.progress = map[string]map[string]Progress{}
+	s.logs = map[string]map[string]RunLog{}
+	s.logData = map[string][]byte{}
+	return s
+}
+
+// run returns the data for a run, creating it if needed.
+func (s *memoryStorage) run(id string) *memoryRun {
+	r, ok := s.runData[id]
+	if !ok {
+		r = &memoryRun{
+			index:     map[string]Instance{},
+			series:    map[string]map[int64]int{},
+			envSeries: map[string]map[int64]int{},
+		}
+		s.runData[id] = r
+	}
+	return r
+}
+
+// StartRun stores a run and makes it the current one.
+func (s *memoryStorage) StartRun(r Run) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.runs[r.ID] = r
+	s.currentrun = r.ID
+	return nil
+}
+
+// CurrentRun returns the run that hits are being recorded against.
+func (s *memoryStorage) CurrentRun() (Run, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, ok := s.runs[s.currentrun]
+	if !ok {
+		return r, ErrCacheMiss
+	}
+	return r, nil
+}
+
+// CurrentRunID returns the ID of the run that hits are being recorded
+// against.
+func (s *memoryStorage) CurrentRunID() (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.runs[s.currentrun]; !ok {
+		return "", ErrCacheMiss
+	}
+	return s.currentrun, nil
+}
+
+// Runs returns all of the runs that have been started.
+func (s *memoryStorage) Runs() (Runs, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	runs := Runs{}
+	for _, r := range s.runs {
+		runs = append(runs, r)
+	}
+
+	return runs, nil
+}
+
+// ClearRun removes a run and all of its hits from memory.
+func (s *memoryStorage) ClearRun(run string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.runs, run)
+	delete(s.runData, run)
+	if s.currentrun == run {
+		s.currentrun = ""
+	}
+	return nil
+}
+
+// Record a hit in memory
+func (s *memoryStorage) Record(run string, instance Instance, at time.Time, bucket int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r := s.run(run)
+
+	ins, ok := r.index[instance.ID]
+	if !ok {
+		ins.FirstSeen = at
+	}
+	ins.ID = instance.ID
+	ins.Env = instance.Env
+	ins.LastSeen = at
+	ins.Incr()
+	r.index[instance.ID] = ins
+
+	if r.series[instance.ID] == nil {
+		r.series[instance.ID] = map[int64]int{}
+	}
+	r.series[instance.ID][bucket]++
+
+	if r.envSeries[instance.Env] == nil {
+		r.envSeries[instance.Env] = map[int64]int{}
+	}
+	r.envSeries[instance.Env][bucket]++
+
+	return nil
+}
+
+// RecordTermination stores when an instance shut down in memory.
+func (s *memoryStorage) RecordTermination(run string, instance Instance, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r := s.run(run)
+
+	ins, ok := r.index[instance.ID]
+	if !ok {
+		return nil
+	}
+	ins.Terminated = at
+	r.index[instance.ID] = ins
+
+	return nil
+}
+
+// RegisterGenerator stores a load producing node in memory.
+func (s *memoryStorage) RegisterGenerator(node Generator) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.loadnodes[node.IP] = node
+	return nil
+}
+
+// RemoveGenerator deletes a load producing node from memory.
+func (s *memoryStorage) RemoveGenerator(ip string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.loadnodes, ip)
+	return nil
+}
+
+// RegisterReceiver stores a receiver endpoint in memory.
+func (s *memoryStorage) RegisterReceiver(r Receiver) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.receivers[r.Endpoint] = r
+	return nil
+}
+
+// RecordReceiverHealth stores the latest probe of a receiver in memory.
+func (s *memoryStorage) RecordReceiverHealth(endpoint string, h ReceiverHealth) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.health[endpoint] = h
+	return nil
+}
+
+// InstanceReport returns the whole collection of all of the instances in a
+// run
+func (s *memoryStorage) InstanceReport(run string) (InstanceReport, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	index := InstanceReport{}
+	r, ok := s.runData[run]
+	if !ok {
+		return index, nil
+	}
+
+	for id, ins := range r.index {
+		index[id] = ins
+	}
+
+	return index, nil
+}
+
+// Series returns the time series of every instance and environment of a run
+// between from and to.
+func (s *memoryStorage) Series(run string, from, to int64) (SeriesReport, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	report := SeriesReport{Instances: map[string]Series{}, Envs: map[string]Series{}}
+	r, ok := s.runData[run]
+	if !ok {
+		return report, nil
+	}
+
+	for id, ins := range r.index {
+		report.Instances[id] = Series{id, ins.Env, memoryPoints(r.series[id], from, to)}
+		report.Envs[ins.Env] = Series{ins.Env, ins.Env, memoryPoints(r.envSeries[ins.Env], from, to)}
+	}
+
+	return report, nil
+}
+
+func memoryPoints(buckets map[int64]int, from, to int64) []Point {
+	points := []Point{}
+	for t, count := range buckets {
+		if t < from || t > to {
+			continue
+		}
+		points = append(points, Point{time.Unix(t, 0), count})
+	}
+	return points
+}
+
+// Generators returns the whole collection of all of the load nodes
+func (s *memoryStorage) Generators() (Generators, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	keys := Generators{}
+	for _, node := range s.loadnodes {
+		keys = append(keys, node)
+	}
+
+	return keys, nil
+}
+
+// Receivers returns the whole collection of all of the receivers
+func (s *memoryStorage) Receivers() (Receivers, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	keys := Receivers{}
+	for _, r := range s.receivers {
+		if h, ok := s.health[r.Endpoint]; ok {
+			r.Health = &h
+		}
+		keys = append(keys, r)
+	}
+
+	return keys, nil
+}
+
+// SaveJob creates or replaces a job in memory.
+func (s *memoryStorage) SaveJob(job Job) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.jobs[job.ID] = copyJob(job)
+	return nil
+}
+
+// UpdateJob replaces a job in memory, keeping any abort.
+func (s *memoryStorage) UpdateJob(job Job) (Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if stored, ok := s.jobs[job.ID]; ok {
+		job = keepAbort(stored, job)
+	}
+
+	s.jobs[job.ID] = copyJob(job)
+	return job, nil
+}
+
+// Job returns a job from memory.
+func (s *memoryStorage) Job(id string) (Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	job, ok := s.jobs[id]
+	if !ok || job.expired(time.Now()) {
+		return Job{}, ErrCacheMiss
+	}
+
+	return copyJob(job), nil
+}
+
+// Jobs returns a summary of every job in memory, dropping jobs that have
+// expired.
+func (s *memoryStorage) Jobs() (Jobs, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	jobs := Jobs{}
+	for id, job := range s.jobs {
+		if job.expired(now) {
+			delete(s.jobs, id)
+			continue
+		}
+		jobs = append(jobs, copyJob(job).Summary())
+	}
+
+	return jobs, nil
+}
+
+// copyJob makes sure that callers never share a job's maps with memory.
+func copyJob(job Job) Job {
+	generators := map[string]GeneratorProgress{}
+	for k, v := range job.Generators {
+		generators[k] = v
+	}
+	job.Generators = generators
+	return job
+}
+
+// SaveProgress replaces the progress of a generator in memory.
+func (s *memoryStorage) SaveProgress(p Progress) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.progress[p.Job]; !ok {
+		s.progress[p.Job] = map[string]Progress{}
+	}
+	s.progress[p.Job][p.IP] = p
+
+	return nil
+}
+
+// Progress returns the progress of every generator on a job from memory.
+func (s *memoryStorage) Progress(job string) ([]Progress, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	list := []Progress{}
+	for _, p := range s.progress[job] {
+		list = append(list, p)
+	}
+
+	return list, nil
+}
+
+// SaveLog replaces the output a generator kept in memory.
+func (s *memoryStorage) SaveLog(l RunLog, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.logs[l.Token]; !ok {
+		s.logs[l.Token] = map[string]RunLog{}
+	}
+	s.logs[l.Token][l.Generator] = l
+	s.logData[l.Token+":"+l.Generator] = append([]byte{}, data...)
+
+	return nil
+}
+
+// Logs lists the logs kept for a token in memory.
+func (s *memoryStorage) Logs(token string) (RunLogs, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	logs := RunLogs{}
+	for _, l := range s.logs[token] {
+		logs = append(logs, l)
+	}
+
+	return logs, nil
+}
+
+// Log returns the output a generator kept for a token in memory.
+func (s *memoryStorage) Log(token, generator string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, ok := s.logData[token+":"+generator]
+	if !ok {
+		return nil, ErrCacheMiss
+	}
+
+	return append([]byte{}, data...), nil
+}
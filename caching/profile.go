@@ -0,0 +1,96 @@
+package caching
+
+import (
+	"fmt"
+	"time"
+)
+
+// Transitions between the stages of a profile.
+const (
+	// TransitionStep jumps to the stage's target as soon as it starts.
+	TransitionStep = "step"
+	// TransitionLinear ramps from the previous stage's target to this one's
+	// over the length of the stage.
+	TransitionLinear = "linear"
+)
+
+// Stage is one step of a load profile. A stage targets either a rate or a
+// concurrency, and every stage of a profile has to target the same one.
+type Stage struct {
+	Duration   string  `json:"duration"`
+	QPS        float64 `json:"qps,omitempty"`
+	C          int     `json:"c,omitempty"`
+	Transition string  `json:"transition,omitempty"`
+}
+
+// Profile is a list of stages that are run one after another, letting a
+// single run show scale up, steady state and scale down.
+type Profile []Stage
+
+// RateDriven reports whether the profile targets a rate rather than a
+// concurrency.
+func (p Profile) RateDriven() bool {
+	for _, s := range p {
+		if s.QPS > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Length is how long the whole profile runs. Stages that can't be parsed
+// count for nothing, since Validate rejects them.
+func (p Profile) Length() time.Duration {
+	var total time.Duration
+	for _, s := range p {
+		if d, err := time.ParseDuration(s.Duration); err == nil && d > 0 {
+			total += d
+		}
+	}
+	return total
+}
+
+// Validate checks that every stage can be run.
+func (p Profile) Validate() error {
+	rate := p.RateDriven()
+
+	for i, s := range p {
+		d, err := time.ParseDuration(s.Duration)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("stage %d: could not get valid value for `duration`: %s", i, s.Duration)
+		}
+
+		switch s.Transition {
+		case "", TransitionStep, TransitionLinear:
+		default:
+			return fmt.Errorf("stage %d: transition must be %s or %s: %s", i, TransitionStep, TransitionLinear, s.Transition)
+		}
+
+		if s.QPS < 0 || s.C < 0 {
+			return fmt.Errorf("stage %d: qps and c cannot be negative", i)
+		}
+
+		if rate && s.C > 0 {
+			return fmt.Errorf("stage %d: a profile can target qps or c, not both", i)
+		}
+	}
+
+	return nil
+}
+
+// split divides the targets of every stage across count generators.
+func (p Profile) split(count int) Profile {
+	per := Profile{}
+	for _, s := range p {
+		s.QPS = s.QPS / float64(count)
+		if s.C > 0 {
+			s.C = s.C / count
+			// Every generator takes part in a stage that has load.
+			if s.C < 1 {
+				s.C = 1
+			}
+		}
+		per = append(per, s)
+	}
+	return per
+}
@@ -0,0 +1,116 @@
+package caching
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// progressTTL is how long redis keeps the progress of a job after the last
+// update, since it is only interesting while a job is running.
+const progressTTL = time.Hour
+
+// Progress is a snapshot of one generator partway through the load of a job.
+// Rate and the latencies cover the time since the generator's previous
+// snapshot, while Sent and Errors are totals for the run so far.
+type Progress struct {
+	Job           string    `json:"job"`
+	IP            string    `json:"ip"`
+	Sent          int       `json:"sent"`
+	Errors        int       `json:"errors"`
+	Rate          float64   `json:"rate"`
+	MeanLatencyMS float64   `json:"meanlatencyms"`
+	MaxLatencyMS  float64   `json:"maxlatencyms"`
+	Done          bool      `json:"done"`
+	Updated       time.Time `json:"updated"`
+}
+
+// JSON Returns the given Progress struct as a JSON string
+func (p Progress) JSON() (string, error) {
+
+	bytes, err := json.Marshal(p)
+	if err != nil {
+		return "", fmt.Errorf("could not marshal json for response: %s", err)
+	}
+
+	return string(bytes), nil
+}
+
+// Load populates a structure with data from json.
+func (p *Progress) Load(s string) error {
+
+	if err := json.Unmarshal([]byte(s), p); err != nil {
+		return err
+	}
+	return nil
+}
+
+// ProgressReport adds up the latest progress of every generator on a job.
+type ProgressReport struct {
+	Job           string     `json:"job"`
+	Sent          int        `json:"sent"`
+	Errors        int        `json:"errors"`
+	Rate          float64    `json:"rate"`
+	MeanLatencyMS float64    `json:"meanlatencyms"`
+	MaxLatencyMS  float64    `json:"maxlatencyms"`
+	Generators    []Progress `json:"generators"`
+}
+
+// JSON Returns the given ProgressReport struct as a JSON string
+func (p ProgressReport) JSON() (string, error) {
+
+	bytes, err := json.Marshal(p)
+	if err != nil {
+		return "", fmt.Errorf("could not marshal json for response: %s", err)
+	}
+
+	return string(bytes), nil
+}
+
+// RecordProgress stores the latest snapshot from a generator, replacing the
+// one before it.
+func (c Cache) RecordProgress(p Progress) error {
+	if len(p.Job) == 0 {
+		return fmt.Errorf("progress has no job")
+	}
+
+	p.Updated = time.Now()
+
+	return c.storage.SaveProgress(p)
+}
+
+// Progress reports how a job is coming along across every generator. The
+// mean latency is weighted by each generator's current rate.
+func (c Cache) Progress(job string) (ProgressReport, error) {
+	report := ProgressReport{Job: job, Generators: []Progress{}}
+
+	list, err := c.storage.Progress(job)
+	if err != nil {
+		return report, err
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].IP < list[j].IP
+	})
+
+	latency := 0.0
+	for _, p := range list {
+		report.Sent += p.Sent
+		report.Errors += p.Errors
+		report.Rate += p.Rate
+		latency += p.MeanLatencyMS * p.Rate
+
+		if p.MaxLatencyMS > report.MaxLatencyMS {
+			report.MaxLatencyMS = p.MaxLatencyMS
+		}
+	}
+
+	if report.Rate > 0 {
+		report.MeanLatencyMS = latency / report.Rate
+	}
+
+	report.Generators = list
+
+	return report, nil
+}
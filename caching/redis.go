@@ -0,0 +1,769 @@
+package caching
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// RedisPool is an interface that allows us to swap in an mock for testing cache
+// code.
+type RedisPool interface {
+	Get() redis.Conn
+}
+
+// redisStorage is the Storage implementation that talks to Redis.
+type redisStorage struct {
+	pool RedisPool
+}
+
+// runKey namespaces a key to a single run.
+func runKey(run, key string) string {
+	return fmt.Sprintf("run:%s:%s", run, key)
+}
+
+func instanceSeriesKey(run, id string) string {
+	return runKey(run, "series:instance:"+id)
+}
+
+func envSeriesKey(run, env string) string {
+	return runKey(run, "series:env:"+env)
+}
+
+// StartRun stores a run and makes it the current one.
+func (s *redisStorage) StartRun(r Run) error {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	rstr, err := r.JSON()
+	if err != nil {
+		return err
+	}
+
+	conn.Send("MULTI")
+
+	if err := conn.Send("HSET", "runs", r.ID, rstr); err != nil {
+		return err
+	}
+
+	if err := conn.Send("SET", "currentrun", r.ID); err != nil {
+		return err
+	}
+
+	if _, err := conn.Do("EXEC"); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// CurrentRun returns the run that hits are being recorded against.
+func (s *redisStorage) CurrentRun() (Run, error) {
+	r := Run{}
+
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	id, err := redis.String(conn.Do("GET", "currentrun"))
+	if err == redis.ErrNil {
+		return r, ErrCacheMiss
+	} else if err != nil {
+		return r, err
+	}
+
+	rstr, err := redis.String(conn.Do("HGET", "runs", id))
+	if err == redis.ErrNil {
+		return r, ErrCacheMiss
+	} else if err != nil {
+		return r, err
+	}
+
+	if err := r.Load(rstr); err != nil {
+		return r, err
+	}
+
+	return r, nil
+}
+
+// CurrentRunID returns the ID of the run that hits are being recorded
+// against, in one round trip.
+func (s *redisStorage) CurrentRunID() (string, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	id, err := redis.String(conn.Do("GET", "currentrun"))
+	if err == redis.ErrNil {
+		return "", ErrCacheMiss
+	}
+	return id, err
+}
+
+// Runs returns all of the runs that have been started.
+func (s *redisStorage) Runs() (Runs, error) {
+	runs := Runs{}
+
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	m, err := redis.StringMap(conn.Do("HGETALL", "runs"))
+	if err == redis.ErrNil {
+		return runs, ErrCacheMiss
+	} else if err != nil {
+		return runs, err
+	}
+
+	for _, v := range m {
+		r := Run{}
+		if err := r.Load(v); err != nil {
+			return runs, err
+		}
+		runs = append(runs, r)
+	}
+
+	return runs, nil
+}
+
+// ClearRun removes a run and all of its hits from redis, leaving every other
+// run and the registries alone.
+func (s *redisStorage) ClearRun(run string) error {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	m, err := redis.StringMap(conn.Do("HGETALL", runKey(run, "index")))
+	if err != nil && err != redis.ErrNil {
+		return err
+	}
+
+	keys := []interface{}{
+		runKey(run, "index"),
+		runKey(run, "counts"),
+		runKey(run, "firstseen"),
+		runKey(run, "lastseen"),
+		runKey(run, "terminated"),
+	}
+
+	envs := map[string]bool{}
+	for id, env := range m {
+		keys = append(keys, instanceSeriesKey(run, id))
+		if !envs[env] {
+			envs[env] = true
+			keys = append(keys, envSeriesKey(run, env))
+		}
+	}
+
+	current, err := redis.String(conn.Do("GET", "currentrun"))
+	if err != nil && err != redis.ErrNil {
+		return err
+	}
+
+	conn.Send("MULTI")
+
+	if err := conn.Send("DEL", keys...); err != nil {
+		return err
+	}
+
+	if err := conn.Send("HDEL", "runs", run); err != nil {
+		return err
+	}
+
+	if current == run {
+		if err := conn.Send("DEL", "currentrun"); err != nil {
+			return err
+		}
+	}
+
+	if _, err := conn.Do("EXEC"); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Record a hit in redis
+func (s *redisStorage) Record(run string, instance Instance, at time.Time, bucket int64) error {
+
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	conn.Send("MULTI")
+
+	if err := conn.Send("HSET", runKey(run, "index"), instance.ID, instance.Env); err != nil {
+		return err
+	}
+
+	if err := conn.Send("HINCRBY", runKey(run, "counts"), instance.ID, 1); err != nil {
+		return err
+	}
+
+	ms := at.UnixNano() / int64(time.Millisecond)
+
+	if err := conn.Send("HSETNX", runKey(run, "firstseen"), instance.ID, ms); err != nil {
+		return err
+	}
+
+	if err := conn.Send("HSET", runKey(run, "lastseen"), instance.ID, ms); err != nil {
+		return err
+	}
+
+	if err := conn.Send("HINCRBY", instanceSeriesKey(run, instance.ID), bucket, 1); err != nil {
+		return err
+	}
+
+	if err := conn.Send("HINCRBY", envSeriesKey(run, instance.Env), bucket, 1); err != nil {
+		return err
+	}
+
+	if _, err := conn.Do("EXEC"); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// RecordTermination stores when an instance shut down in redis.
+func (s *redisStorage) RecordTermination(run string, instance Instance, at time.Time) error {
+
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	ms := at.UnixNano() / int64(time.Millisecond)
+
+	if _, err := conn.Do("HSET", runKey(run, "terminated"), instance.ID, ms); err != nil {
+		return fmt.Errorf("cannot set termination in redis: %s", err)
+	}
+
+	return nil
+}
+
+// RegisterGenerator stores a load producing node in redis.
+func (s *redisStorage) RegisterGenerator(node Generator) error {
+
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	nodestr, err := node.JSON()
+	if err != nil {
+		return err
+	}
+
+	if _, err := conn.Do("HSET", "loadnodes", node.IP, nodestr); err != nil {
+		return fmt.Errorf("cannot set loadnodes in redis: %s", err)
+	}
+
+	return nil
+}
+
+// RemoveGenerator deletes a load producing node from redis.
+func (s *redisStorage) RemoveGenerator(ip string) error {
+
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	if _, err := conn.Do("HDEL", "loadnodes", ip); err != nil {
+		return fmt.Errorf("cannot remove loadnode from redis: %s", err)
+	}
+
+	return nil
+}
+
+// RegisterReceiver stores a receiver endpoint in redis.
+func (s *redisStorage) RegisterReceiver(r Receiver) error {
+
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	rstr, err := r.JSON()
+	if err != nil {
+		return err
+	}
+
+	if _, err := conn.Do("HSET", "receivers", r.Endpoint, rstr); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// RecordReceiverHealth stores the latest probe of a receiver in redis.
+func (s *redisStorage) RecordReceiverHealth(endpoint string, h ReceiverHealth) error {
+
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	hstr, err := h.JSON()
+	if err != nil {
+		return err
+	}
+
+	if _, err := conn.Do("HSET", "receiverhealth", endpoint, hstr); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// InstanceReport returns the whole collection of all of the instances in a
+// run
+func (s *redisStorage) InstanceReport(run string) (InstanceReport, error) {
+	index := InstanceReport{}
+
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	m, err := redis.StringMap(conn.Do("HGETALL", runKey(run, "index")))
+	if err == redis.ErrNil {
+		return index, ErrCacheMiss
+	} else if err != nil {
+		return index, err
+	}
+
+	for id, env := range m {
+		index[id] = Instance{ID: id, Env: env}
+	}
+
+	counts, err := redis.IntMap(conn.Do("HGETALL", runKey(run, "counts")))
+	if err == redis.ErrNil {
+		return index, ErrCacheMiss
+	} else if err != nil {
+		return index, err
+	}
+
+	for id, count := range counts {
+		ins, ok := index[id]
+		if !ok {
+			return index, fmt.Errorf("could not get instance from index")
+		}
+
+		ins.Count = count
+		index[id] = ins
+	}
+
+	if err := redisSeen(conn, runKey(run, "firstseen"), index, func(ins *Instance, t time.Time) {
+		ins.FirstSeen = t
+	}); err != nil {
+		return index, err
+	}
+
+	if err := redisSeen(conn, runKey(run, "lastseen"), index, func(ins *Instance, t time.Time) {
+		ins.LastSeen = t
+	}); err != nil {
+		return index, err
+	}
+
+	if err := redisSeen(conn, runKey(run, "terminated"), index, func(ins *Instance, t time.Time) {
+		ins.Terminated = t
+	}); err != nil {
+		return index, err
+	}
+
+	return index, nil
+}
+
+// redisSeen reads a hash of instance timestamps in milliseconds and applies
+// them to the instances in the index.
+func redisSeen(conn redis.Conn, key string, index InstanceReport, set func(*Instance, time.Time)) error {
+	m, err := redis.Int64Map(conn.Do("HGETALL", key))
+	if err != nil && err != redis.ErrNil {
+		return err
+	}
+
+	for id, ms := range m {
+		ins, ok := index[id]
+		if !ok {
+			continue
+		}
+		set(&ins, time.Unix(0, ms*int64(time.Millisecond)))
+		index[id] = ins
+	}
+
+	return nil
+}
+
+// Series returns the time series of every instance and environment of a run
+// between from and to.
+func (s *redisStorage) Series(run string, from, to int64) (SeriesReport, error) {
+	report := SeriesReport{Instances: map[string]Series{}, Envs: map[string]Series{}}
+
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	m, err := redis.StringMap(conn.Do("HGETALL", runKey(run, "index")))
+	if err == redis.ErrNil {
+		return report, ErrCacheMiss
+	} else if err != nil {
+		return report, err
+	}
+
+	for id, env := range m {
+		points, err := redisPoints(conn, instanceSeriesKey(run, id), from, to)
+		if err != nil {
+			return report, err
+		}
+		report.Instances[id] = Series{id, env, points}
+
+		if _, ok := report.Envs[env]; ok {
+			continue
+		}
+
+		points, err = redisPoints(conn, envSeriesKey(run, env), from, to)
+		if err != nil {
+			return report, err
+		}
+		report.Envs[env] = Series{env, env, points}
+	}
+
+	return report, nil
+}
+
+// redisPoints reads the buckets of one series hash that fall between from and
+// to.
+func redisPoints(conn redis.Conn, key string, from, to int64) ([]Point, error) {
+	points := []Point{}
+
+	m, err := redis.IntMap(conn.Do("HGETALL", key))
+	if err != nil && err != redis.ErrNil {
+		return points, err
+	}
+
+	for k, count := range m {
+		t, err := strconv.ParseInt(k, 10, 64)
+		if err != nil {
+			return points, fmt.Errorf("could not parse series bucket %s: %s", k, err)
+		}
+
+		if t < from || t > to {
+			continue
+		}
+
+		points = append(points, Point{time.Unix(t, 0), count})
+	}
+
+	return points, nil
+}
+
+// Generators returns the whole collection of all of the load nodes
+func (s *redisStorage) Generators() (Generators, error) {
+	keys := Generators{}
+
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	m, err := redis.StringMap(conn.Do("HGETALL", "loadnodes"))
+	if err == redis.ErrNil {
+		return keys, ErrCacheMiss
+	} else if err != nil {
+		return keys, err
+	}
+
+	for _, v := range m {
+		node := Generator{}
+		err := node.Load(v)
+		if err != nil {
+			return keys, err
+		}
+
+		keys = append(keys, node)
+	}
+
+	return keys, nil
+}
+
+// Receivers returns the whole collection of all of the receivers
+func (s *redisStorage) Receivers() (Receivers, error) {
+	keys := Receivers{}
+
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	m, err := redis.StringMap(conn.Do("HGETALL", "receivers"))
+	if err == redis.ErrNil {
+		return keys, ErrCacheMiss
+	} else if err != nil {
+		return keys, err
+	}
+
+	health, err := redis.StringMap(conn.Do("HGETALL", "receiverhealth"))
+	if err != nil && err != redis.ErrNil {
+		return keys, err
+	}
+
+	for _, v := range m {
+		r := Receiver{}
+		err := r.Load(v)
+		if err != nil {
+			return keys, err
+		}
+
+		if hstr, ok := health[r.Endpoint]; ok {
+			h := ReceiverHealth{}
+			if err := h.Load(hstr); err != nil {
+				return keys, err
+			}
+			r.Health = &h
+		}
+
+		keys = append(keys, r)
+	}
+
+	return keys, nil
+}
+
+// SaveJob creates or replaces a job in redis. The whole job is kept under
+// its own key, which expires, and a summary of it goes in the jobsummaries
+// hash for listing, which Jobs prunes.
+func (s *redisStorage) SaveJob(job Job) error {
+
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	jstr, err := job.JSON()
+	if err != nil {
+		return err
+	}
+
+	sstr, err := job.Summary().JSON()
+	if err != nil {
+		return err
+	}
+
+	conn.Send("MULTI")
+	conn.Send("SET", "job:"+job.ID, jstr, "EX", int(jobTTL.Seconds()))
+	conn.Send("HSET", "jobsummaries", job.ID, sstr)
+	if _, err := conn.Do("EXEC"); err != nil {
+		return fmt.Errorf("cannot set job in redis: %s", err)
+	}
+
+	return nil
+}
+
+// UpdateJob replaces a job in redis, keeping any abort. The job's key is
+// watched while it is checked, and the write is retried if anything else
+// changed it in the meantime.
+func (s *redisStorage) UpdateJob(job Job) (Job, error) {
+
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	key := "job:" + job.ID
+
+	for {
+		if _, err := conn.Do("WATCH", key); err != nil {
+			return job, fmt.Errorf("cannot watch job in redis: %s", err)
+		}
+
+		update := job
+		jstr, err := redis.String(conn.Do("GET", key))
+		switch {
+		case err == redis.ErrNil:
+		case err != nil:
+			conn.Do("UNWATCH")
+			return job, err
+		default:
+			stored := Job{}
+			if err := stored.Load(jstr); err != nil {
+				conn.Do("UNWATCH")
+				return job, err
+			}
+			update = keepAbort(stored, job)
+		}
+
+		ustr, err := update.JSON()
+		if err != nil {
+			conn.Do("UNWATCH")
+			return job, err
+		}
+
+		sstr, err := update.Summary().JSON()
+		if err != nil {
+			conn.Do("UNWATCH")
+			return job, err
+		}
+
+		conn.Send("MULTI")
+		conn.Send("SET", key, ustr, "EX", int(jobTTL.Seconds()))
+		conn.Send("HSET", "jobsummaries", job.ID, sstr)
+		reply, err := conn.Do("EXEC")
+		if err != nil {
+			return job, fmt.Errorf("cannot set job in redis: %s", err)
+		}
+
+		// A nil reply means the job changed after it was read.
+		if reply != nil {
+			return update, nil
+		}
+	}
+}
+
+// Job returns a job from redis.
+func (s *redisStorage) Job(id string) (Job, error) {
+	job := Job{}
+
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	jstr, err := redis.String(conn.Do("GET", "job:"+id))
+	if err == redis.ErrNil {
+		return job, ErrCacheMiss
+	} else if err != nil {
+		return job, err
+	}
+
+	if err := job.Load(jstr); err != nil {
+		return job, err
+	}
+
+	return job, nil
+}
+
+// Jobs returns a summary of every job in redis, dropping the summaries of
+// jobs that have expired.
+func (s *redisStorage) Jobs() (Jobs, error) {
+	jobs := Jobs{}
+
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	m, err := redis.StringMap(conn.Do("HGETALL", "jobsummaries"))
+	if err == redis.ErrNil {
+		return jobs, ErrCacheMiss
+	} else if err != nil {
+		return jobs, err
+	}
+
+	now := time.Now()
+	expired := []interface{}{"jobsummaries"}
+
+	for id, v := range m {
+		job := Job{}
+		if err := job.Load(v); err != nil {
+			return jobs, err
+		}
+
+		if job.expired(now) {
+			expired = append(expired, id)
+			continue
+		}
+		jobs = append(jobs, job)
+	}
+
+	if len(expired) > 1 {
+		if _, err := conn.Do("HDEL", expired...); err != nil {
+			return jobs, fmt.Errorf("cannot prune jobs in redis: %s", err)
+		}
+	}
+
+	return jobs, nil
+}
+
+// SaveProgress replaces the progress of a generator in redis.
+func (s *redisStorage) SaveProgress(p Progress) error {
+
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	pstr, err := p.JSON()
+	if err != nil {
+		return err
+	}
+
+	key := "progress:" + p.Job
+
+	conn.Send("MULTI")
+	conn.Send("HSET", key, p.IP, pstr)
+	conn.Send("EXPIRE", key, int(progressTTL.Seconds()))
+	if _, err := conn.Do("EXEC"); err != nil {
+		return fmt.Errorf("cannot set progress in redis: %s", err)
+	}
+
+	return nil
+}
+
+// Progress returns the progress of every generator on a job from redis.
+func (s *redisStorage) Progress(job string) ([]Progress, error) {
+	list := []Progress{}
+
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	m, err := redis.StringMap(conn.Do("HGETALL", "progress:"+job))
+	if err != nil {
+		return list, err
+	}
+
+	for _, v := range m {
+		p := Progress{}
+		if err := p.Load(v); err != nil {
+			return list, err
+		}
+		list = append(list, p)
+	}
+
+	return list, nil
+}
+
+// SaveLog replaces the output a generator kept in redis. Logs expire after a
+// while, since they are only kept for debugging.
+func (s *redisStorage) SaveLog(l RunLog, data []byte) error {
+
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	lstr, err := l.JSON()
+	if err != nil {
+		return err
+	}
+
+	index := "logs:" + l.Token
+	ttl := int(logTTL.Seconds())
+
+	conn.Send("MULTI")
+	conn.Send("HSET", index, l.Generator, lstr)
+	conn.Send("EXPIRE", index, ttl)
+	conn.Send("SET", "log:"+l.Token+":"+l.Generator, data, "EX", ttl)
+	if _, err := conn.Do("EXEC"); err != nil {
+		return fmt.Errorf("cannot set log in redis: %s", err)
+	}
+
+	return nil
+}
+
+// Logs lists the logs kept for a token in redis.
+func (s *redisStorage) Logs(token string) (RunLogs, error) {
+	logs := RunLogs{}
+
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	m, err := redis.StringMap(conn.Do("HGETALL", "logs:"+token))
+	if err != nil {
+		return logs, err
+	}
+
+	for _, v := range m {
+		l := RunLog{}
+		if err := l.Load(v); err != nil {
+			return logs, err
+		}
+		logs = append(logs, l)
+	}
+
+	return logs, nil
+}
+
+// Log returns the output a generator kept for a token in redis.
+func (s *redisStorage) Log(token, generator string) ([]byte, error) {
+
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	data, err := redis.Bytes(conn.Do("GET", "log:"+token+":"+generator))
+	if err == redis.ErrNil {
+		return nil, ErrCacheMiss
+	} else if err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
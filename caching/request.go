@@ -0,0 +1,54 @@
+package caching
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// maxBodySize caps the generated body of a request template, since every
+// generator holds it in memory for the length of the run.
+const maxBodySize = 10 * 1024 * 1024
+
+// RequestTemplate is the shape of every request a generator sends. The zero
+// value is a plain GET.
+type RequestTemplate struct {
+	Method  string            `json:"method,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+	// Body is sent as is. BodySize instead sends a generated body of that
+	// many bytes, for when only the size of the payload matters.
+	Body        string `json:"body,omitempty"`
+	BodySize    int    `json:"bodysize,omitempty"`
+	ContentType string `json:"contenttype,omitempty"`
+}
+
+// Validate checks that the template describes a request that can be sent.
+func (t RequestTemplate) Validate() error {
+	if strings.IndexFunc(t.Method, func(r rune) bool { return r < 'A' || r > 'Z' }) >= 0 {
+		return fmt.Errorf("could not get valid value for `method`: %s", t.Method)
+	}
+
+	if len(t.Body) > 0 && t.BodySize > 0 {
+		return fmt.Errorf("a request can have `body` or `bodysize`, not both")
+	}
+
+	if t.BodySize < 0 || t.BodySize > maxBodySize {
+		return fmt.Errorf("`bodysize` must be between 0 and %d: %d", maxBodySize, t.BodySize)
+	}
+
+	for k := range t.Headers {
+		if len(k) == 0 || strings.ContainsAny(k, " :\r\n") {
+			return fmt.Errorf("could not get valid header name: %q", k)
+		}
+	}
+
+	return nil
+}
+
+// HTTPMethod is the method of the request, GET if none was given.
+func (t RequestTemplate) HTTPMethod() string {
+	if len(t.Method) == 0 {
+		return http.MethodGet
+	}
+	return t.Method
+}
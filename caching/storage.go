@@ -0,0 +1,55 @@
+package caching
+
+import "time"
+
+// Storage is the interface that the cache uses to persist its data. It allows
+// us to swap Redis out for an in process implementation.
+type Storage interface {
+	// StartRun stores a run and makes it the one hits are recorded against.
+	StartRun(r Run) error
+	// CurrentRun returns ErrCacheMiss if no run has been started.
+	CurrentRun() (Run, error)
+	// CurrentRunID is CurrentRun for callers that only need the ID, like
+	// recording a hit, and returns ErrCacheMiss the same way.
+	CurrentRunID() (string, error)
+	Runs() (Runs, error)
+	// ClearRun deletes a run and everything recorded against it.
+	ClearRun(run string) error
+	// Record counts a hit for the instance at a point in time, both in total
+	// and in the time series bucket starting at the given unix time.
+	Record(run string, instance Instance, at time.Time, bucket int64) error
+	// RecordTermination stores when an instance of a run shut down.
+	RecordTermination(run string, instance Instance, at time.Time) error
+	RegisterGenerator(node Generator) error
+	RemoveGenerator(ip string) error
+	RegisterReceiver(r Receiver) error
+	// RecordReceiverHealth stores the latest probe of a receiver, which is
+	// returned as part of Receivers.
+	RecordReceiverHealth(endpoint string, h ReceiverHealth) error
+	InstanceReport(run string) (InstanceReport, error)
+	// Series returns the raw time series buckets between from and to, in unix
+	// seconds.
+	Series(run string, from, to int64) (SeriesReport, error)
+	Generators() (Generators, error)
+	Receivers() (Receivers, error)
+	// SaveJob creates or replaces a job.
+	SaveJob(job Job) error
+	// UpdateJob replaces a job unless it has been aborted, in which case the
+	// abort is kept, and returns what was written. The check and the write
+	// are atomic.
+	UpdateJob(job Job) (Job, error)
+	// Job returns ErrCacheMiss if there is no job with that ID.
+	Job(id string) (Job, error)
+	// Jobs returns summaries of the jobs that haven't expired.
+	Jobs() (Jobs, error)
+	// SaveProgress replaces the progress of a generator on a job.
+	SaveProgress(p Progress) error
+	// Progress returns the latest progress of every generator on a job.
+	Progress(job string) ([]Progress, error)
+	// SaveLog replaces the output a generator kept for a token.
+	SaveLog(l RunLog, data []byte) error
+	Logs(token string) (RunLogs, error)
+	// Log returns ErrCacheMiss if there is no log for the token and
+	// generator.
+	Log(token, generator string) ([]byte, error)
+}
@@ -0,0 +1,197 @@
+// Package discovery works out the address a service should advertise so that
+// others can reach it, trying a list of strategies in order.
+package discovery
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/compute/metadata"
+)
+
+// Address is where a service can be reached.
+type Address struct {
+	Host string `json:"host"`
+	// Port is empty when the service is reached on the scheme's default
+	// port, like behind the port mapping of a GCE VM.
+	Port string `json:"port,omitempty"`
+	// Source is the name of the strategy that found the address.
+	Source string `json:"source"`
+}
+
+// String returns the address as host or host:port.
+func (a Address) String() string {
+	if len(a.Port) == 0 {
+		return a.Host
+	}
+	return net.JoinHostPort(a.Host, a.Port)
+}
+
+// Strategy is one way of finding an address.
+type Strategy struct {
+	Name string
+	// Find returns a host, or a host:port to use that port.
+	Find func() (string, error)
+	// ListenPort is whether the service's own listen port is reachable on
+	// the host that Find returns. It isn't for addresses that are mapped
+	// through NAT, like a VM's external IP.
+	ListenPort bool
+}
+
+// Override advertises the given address, like one set with a flag or an env
+// variable. An empty address makes the strategy fail so that the next one is
+// tried.
+func Override(addr string) Strategy {
+	return Strategy{
+		Name: "override",
+		Find: func() (string, error) {
+			if len(addr) == 0 {
+				return "", errors.New("no address set")
+			}
+			return addr, nil
+		},
+		ListenPort: true,
+	}
+}
+
+// PodIP advertises the IP that Kubernetes passes in the POD_IP env variable
+// through the downward API.
+func PodIP() Strategy {
+	return Strategy{
+		Name: "pod",
+		Find: func() (string, error) {
+			ip := os.Getenv("POD_IP")
+			if len(ip) == 0 {
+				return "", errors.New("POD_IP is not set")
+			}
+			return ip, nil
+		},
+		ListenPort: true,
+	}
+}
+
+// Metadata advertises the external IP of a GCE VM, from the metadata server.
+func Metadata() Strategy {
+	return Strategy{
+		Name: "metadata",
+		Find: func() (string, error) {
+			client := metadata.NewClient(&http.Client{
+				Transport: userAgentTransport{
+					userAgent: "loadgenerator",
+					base:      http.DefaultTransport,
+				},
+				Timeout: 1 * time.Second})
+
+			return client.ExternalIP()
+		},
+	}
+}
+
+// Interface advertises the first IPv4 address of a network interface that is
+// up and isn't loopback.
+func Interface() Strategy {
+	return Strategy{
+		Name: "interface",
+		Find: func() (string, error) {
+			ifaces, err := net.Interfaces()
+			if err != nil {
+				return "", err
+			}
+
+			for _, iface := range ifaces {
+				if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+					continue
+				}
+
+				addrs, err := iface.Addrs()
+				if err != nil {
+					continue
+				}
+
+				for _, a := range addrs {
+					ipnet, ok := a.(*net.IPNet)
+					if !ok || ipnet.IP.To4() == nil {
+						continue
+					}
+					return ipnet.IP.String(), nil
+				}
+			}
+
+			return "", errors.New("no interface has an IPv4 address")
+		},
+		ListenPort: true,
+	}
+}
+
+// Default is the order strategies are tried in unless told otherwise.
+var Default = []string{"override", "pod", "metadata", "interface"}
+
+// Strategies returns the named strategies in order, with override using the
+// given address.
+func Strategies(names []string, override string) ([]Strategy, error) {
+	all := map[string]Strategy{
+		"override":  Override(override),
+		"pod":       PodIP(),
+		"metadata":  Metadata(),
+		"interface": Interface(),
+	}
+
+	list := []Strategy{}
+	for _, name := range names {
+		s, ok := all[strings.TrimSpace(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown address strategy: %s", name)
+		}
+		list = append(list, s)
+	}
+
+	return list, nil
+}
+
+// Discover tries each strategy in turn and returns the first address found.
+// A port in the found address is used as is. Otherwise advertise, the port
+// the service was explicitly told to advertise, is used if it is set, and
+// listen, the service's own listen port, only for strategies whose hosts
+// can reach it directly.
+func Discover(listen, advertise string, strategies ...Strategy) (Address, error) {
+	failures := []string{}
+
+	for _, s := range strategies {
+		found, err := s.Find()
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %s", s.Name, err))
+			continue
+		}
+
+		a := Address{Host: found, Source: s.Name}
+		switch host, p, err := net.SplitHostPort(found); {
+		case err == nil:
+			a.Host, a.Port = host, p
+		case len(advertise) > 0:
+			a.Port = advertise
+		case s.ListenPort:
+			a.Port = listen
+		}
+
+		return a, nil
+	}
+
+	return Address{}, fmt.Errorf("could not find an address to advertise: %s", strings.Join(failures, "; "))
+}
+
+// userAgentTransport sets the User-Agent header before calling base.
+type userAgentTransport struct {
+	userAgent string
+	base      http.RoundTripper
+}
+
+// RoundTrip implements the http.RoundTripper interface.
+func (t userAgentTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req.Header.Set("User-Agent", t.userAgent)
+	return t.base.RoundTrip(req)
+}
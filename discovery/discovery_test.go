@@ -0,0 +1,44 @@
+package discovery
+
+import (
+	"errors"
+	"testing"
+)
+
+func found(name, addr string, listenPort bool) Strategy {
+	return Strategy{Name: name, Find: func() (string, error) { return addr, nil }, ListenPort: listenPort}
+}
+
+func TestDiscover(t *testing.T) {
+	failing := Strategy{Name: "broken", Find: func() (string, error) { return "", errors.New("nothing here") }}
+
+	cases := []struct {
+		name       string
+		advertise  string
+		strategies []Strategy
+		want       Address
+	}{
+		{"listen port", "", []Strategy{found("pod", "10.0.0.1", true)}, Address{"10.0.0.1", "8080", "pod"}},
+		{"no listen port behind nat", "", []Strategy{found("metadata", "34.1.2.3", false)}, Address{"34.1.2.3", "", "metadata"}},
+		{"advertise port", "9090", []Strategy{found("pod", "10.0.0.1", true)}, Address{"10.0.0.1", "9090", "pod"}},
+		{"advertise port behind nat", "80", []Strategy{found("metadata", "34.1.2.3", false)}, Address{"34.1.2.3", "80", "metadata"}},
+		{"port in address", "9090", []Strategy{found("override", "example.com:8082", true)}, Address{"example.com", "8082", "override"}},
+		{"next strategy", "", []Strategy{failing, found("interface", "192.168.1.2", true)}, Address{"192.168.1.2", "8080", "interface"}},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := Discover("8080", tc.advertise, tc.strategies...)
+			if err != nil {
+				t.Fatalf("Discover() got error: %s", err)
+			}
+			if got != tc.want {
+				t.Errorf("Discover() = %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+
+	if _, err := Discover("8080", "", failing); err == nil {
+		t.Errorf("Discover() with every strategy failing got no error")
+	}
+}
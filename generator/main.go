@@ -3,19 +3,24 @@ package main
 import (
 	"context"
 	"errors"
+	"flag"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
 	"os"
-	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
-	"cloud.google.com/go/compute/metadata"
 	"cloud.google.com/go/logging"
 	"github.com/tpryan/scaling/apitools"
 	"github.com/tpryan/scaling/caching"
+	"github.com/tpryan/scaling/discovery"
+	"github.com/tpryan/scaling/loadgen"
 )
 
 var (
@@ -23,20 +28,62 @@ var (
 	debug        = true
 	port         = ""
 	selfHostName = ""
-	active       = false
+	advertised   = discovery.Address{}
 	nodeID       = ""
 	logger       *logging.Logger
 	logWorking   = true
 	receviers    = []*url.URL{}
+	// logSink keeps the output of every run, picked with the LOG_SINK env
+	// variable.
+	logSink loadgen.LogSink
+	// runs makes sure only one run happens at a time, queueing up to
+	// RUN_QUEUE_DEPTH more.
+	runs = &runQueue{}
+	// defaultEngine is the load engine used when a request doesn't ask for
+	// one, set with the LOAD_ENGINE env variable.
+	defaultEngine = loadgen.EngineAB
+	// targetPolicy limits where load can be sent, set with the TARGET_*
+	// env variables.
+	targetPolicy = loadgen.TargetPolicy{}
+	// shutdownTimeout is how long in-flight requests get to finish once
+	// the generator is told to stop.
+	shutdownTimeout = 10 * time.Second
+	// advertise overrides the address the generator registers, as host or
+	// host:port. The ADVERTISE_ADDR env variable does the same.
+	advertise = flag.String("advertise", "", "address to register with, as host or host:port")
 )
 
 func main() {
 	var err error
 
+	flag.Parse()
+
 	redisHost := os.Getenv("REDISHOST")
 	redisPort := os.Getenv("REDISPORT")
 	projectID := os.Getenv("PROJECTID")
 
+	if e := os.Getenv("LOAD_ENGINE"); len(e) > 0 {
+		if _, err := loadgen.NewEngine(e); err != nil {
+			log.Fatal(err)
+		}
+		defaultEngine = e
+	}
+
+	if d := os.Getenv("RUN_QUEUE_DEPTH"); len(d) > 0 {
+		depth, err := strconv.Atoi(d)
+		if err != nil || depth < 0 {
+			log.Fatal(fmt.Errorf("invalid value for env variable `RUN_QUEUE_DEPTH`: %s", d))
+		}
+		runs.depth = depth
+	}
+
+	targetPolicy = loadgen.TargetPolicy{
+		Schemes:      envList("TARGET_SCHEMES"),
+		PathPrefixes: envList("TARGET_PATH_PREFIXES"),
+		Allow:        envList("TARGET_ALLOW"),
+		Deny:         envList("TARGET_DENY"),
+	}
+
 	logger, err = getLogger(projectID)
 	if err != nil {
 		logWorking = false
@@ -54,52 +101,140 @@ func main() {
 		log.Fatal(fmt.Errorf("could not start cache: %w", err))
 	}
 
+	switch s := os.Getenv("LOG_SINK"); s {
+	case "", "cache":
+		logSink = cache
+	case "file":
+		dir := os.Getenv("LOG_DIR")
+		if len(dir) == 0 {
+			dir = os.TempDir()
+		}
+		logSink = loadgen.FileSink{Dir: dir}
+	default:
+		log.Fatal(fmt.Errorf("invalid value for env variable `LOG_SINK`: %s", s))
+	}
+
 	nodeID, err = caching.CreateID()
 	if err != nil {
 		sdlog("could not create cache id", err)
 		log.Fatal(fmt.Errorf("could not create cache id: %w", err))
 	}
 
-	selfHostName, err = getHostIP()
+	// Commands have to be signed by the visualizer with CONTROL_SECRET,
+	// since generators are open to the internet. Taking unsigned commands
+	// has to be asked for with ALLOW_UNSIGNED_CONTROL, for local demos.
+	control := func(h http.HandlerFunc) http.HandlerFunc { return h }
+	switch secret := os.Getenv("CONTROL_SECRET"); {
+	case len(secret) > 0:
+		verifier := apitools.NewVerifier([]byte(secret), apitools.DefaultMaxSkew)
+		control = verifier.Require
+	case os.Getenv("ALLOW_UNSIGNED_CONTROL") == "true":
+		log.Printf("WARNING: CONTROL_SECRET is not set and ALLOW_UNSIGNED_CONTROL is on, anyone who can reach this generator can make it send load")
+	default:
+		log.Fatal("CONTROL_SECRET is not set, set it to the visualizer's secret or set ALLOW_UNSIGNED_CONTROL=true to accept unsigned commands")
+	}
+
+	advertised, err = advertiseAddress()
 	if err != nil {
-		selfHostName = "docker.for.mac.localhost:8082"
+		sdlog("could not work out an address", err)
+		log.Fatal(err)
 	}
+	selfHostName = advertised.String()
+	fmt.Printf("advertising %s, found by %s\n", selfHostName, advertised.Source)
 
-	if err := cache.RegisterGenerator(nodeID, selfHostName, false); err != nil {
+	if err := cache.SaveGenerator(generatorRecord()); err != nil {
 		msg := fmt.Sprintf("caching issue host: %s port: %s\n", redisHost, redisPort)
 		sdlog(msg, err)
 		log.Fatal(fmt.Errorf("could not register the generator: %w", err))
 	}
 
-	go startPolling()
+	stopPolling := make(chan struct{})
+	pollingStopped := make(chan struct{})
+	go startPolling(stopPolling, pollingStopped)
 
-	http.HandleFunc("/", indexHandler)
+	http.HandleFunc("/", control(indexHandler))
 	http.HandleFunc("/healthz", handleHealth)
+	http.HandleFunc("/abort", control(handleAbort))
+	http.HandleFunc("/status", handleStatus)
+	http.HandleFunc("/metrics", handleMetrics)
+
+	srv := &http.Server{Addr: port}
+
+	// Cloud Run and GKE send SIGTERM before killing an instance, so the
+	// generator stops its load and drops out of the registry rather than
+	// lingering until its heartbeat goes stale.
+	stopped := make(chan struct{})
+	go func() {
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGTERM, os.Interrupt)
+		<-sigs
+
+		fmt.Printf("shutting down\n")
+		close(stopPolling)
+		runs.abortAll()
+
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			sdlog("could not shut down webserver cleanly", err)
+		}
+
+		// A heartbeat that lands after the generator is removed would
+		// register it again.
+		<-pollingStopped
+		if err := cache.RemoveGenerator(selfHostName); err != nil {
+			sdlog("could not deregister node", err)
+		}
+
+		close(stopped)
+	}()
 
 	fmt.Printf("starting webserver\n")
-	if err := http.ListenAndServe(port, nil); err != nil {
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
 		sdlog("could not start webserver", err)
 		log.Fatal(fmt.Errorf("could not start webserver: %w", err))
 	}
+
+	<-stopped
+}
+
+// verifyURL checks a target against the policy, so that generators can only
+// be pointed at the services they are meant to test - no ddosing.
+func verifyURL(URLString string) *caching.Rejection {
+	rejection := targetPolicy.Check(URLString, receviers)
+	if rejection != nil {
+		fmt.Printf("URL: %s rejected: %s\n", URLString, rejection)
+		return rejection
+	}
+
+	fmt.Printf("URL: %s verified\n", URLString)
+	return nil
 }
 
-func verifyURL(URLString string) bool {
-	fmt.Printf("URL: %s\n", URLString)
-	u, err := url.Parse(URLString)
+// withToken adds the run's token to the target's query, keeping any query it
+// already has, so receivers can tell which run a hit belongs to.
+func withToken(target, token string) (string, error) {
+	u, err := url.Parse(target)
 	if err != nil {
-		fmt.Printf("Verified: true \n")
-		return false
+		return "", fmt.Errorf("could not parse url: %s", err)
 	}
 
-	for _, v := range receviers {
-		if v.Hostname() == u.Hostname() && v.Port() == u.Port() {
-			fmt.Printf("Verified: true \n")
-			return true
+	q := u.Query()
+	q.Set("token", token)
+	u.RawQuery = q.Encode()
+
+	return u.String(), nil
+}
+
+// envList reads a comma separated list from the environment.
+func envList(name string) []string {
+	list := []string{}
+	for _, v := range strings.Split(os.Getenv(name), ",") {
+		if v = strings.TrimSpace(v); len(v) > 0 {
+			list = append(list, v)
 		}
 	}
-
-	fmt.Printf("Verified: true \n")
-	return false
+	return list
 }
 
 func getLogger(projectID string) (*logging.Logger, error) {
@@ -111,12 +246,55 @@ func getLogger(projectID string) (*logging.Logger, error) {
 	return client.Logger("generator"), nil
 }
 
-func registerNode() {
+// advertiseAddress works out where the visualizer can reach this generator,
+// trying the strategies in ADVERTISE_STRATEGIES in order. ADVERTISE_PORT sets
+// the port to advertise if it differs from the one listened on.
+func advertiseAddress() (discovery.Address, error) {
+	override := *advertise
+	if len(override) == 0 {
+		override = os.Getenv("ADVERTISE_ADDR")
+	}
 
-	err := cache.RegisterGenerator(nodeID, selfHostName, active)
+	names := discovery.Default
+	if s := os.Getenv("ADVERTISE_STRATEGIES"); len(s) > 0 {
+		names = strings.Split(s, ",")
+	}
+
+	strategies, err := discovery.Strategies(names, override)
 	if err != nil {
+		return discovery.Address{}, err
+	}
+
+	listen := strings.TrimPrefix(port, ":")
+	return discovery.Discover(listen, os.Getenv("ADVERTISE_PORT"), strategies...)
+}
+
+// generatorRecord describes this generator and what it is working on.
+func generatorRecord() caching.Generator {
+	busy, job, depth := runs.status()
+	return caching.Generator{
+		ID:         nodeID,
+		IP:         selfHostName,
+		Address:    advertised.Host,
+		Port:       advertised.Port,
+		Discovery:  advertised.Source,
+		Active:     busy,
+		CurrentJob: job,
+		QueueDepth: depth,
+	}
+}
+
+// publishState registers the generator straight away rather than waiting for
+// the next poll, so the visualizer sees runs start and stop.
+func publishState() {
+	if err := cache.SaveGenerator(generatorRecord()); err != nil {
 		sdlog("could not register node", err)
 	}
+}
+
+func registerNode() {
+
+	publishState()
 
 	rs, err := cache.Receivers()
 	if err != nil {
@@ -130,119 +308,331 @@ func registerNode() {
 
 }
 
+// handleAbort stops the run in progress. If a job is given, the run is only
+// stopped if it belongs to that job, and any runs of the job still in the
+// queue are dropped.
+func handleAbort(w http.ResponseWriter, r *http.Request) {
+	job := r.URL.Query().Get("job")
+
+	if !runs.abort(job) {
+		apitools.Success(w, "nothing to abort")
+		return
+	}
+
+	fmt.Printf("aborted load for job %s\n", job)
+	apitools.Success(w, "aborted")
+	return
+}
+
+// handleStatus reports whether a run is going and how many are queued.
+func handleStatus(w http.ResponseWriter, r *http.Request) {
+	apitools.JSON(w, generatorRecord())
+	return
+}
+
 func handleHealth(w http.ResponseWriter, r *http.Request) {
 	apitools.Success(w, "ok")
 	return
 }
 
-func startPolling() {
+// startPolling registers the generator every second until stop is closed.
+// It closes stopped once the ticker is stopped and every registration it
+// started is over.
+func startPolling(stop, stopped chan struct{}) {
 	fmt.Printf("starting register polling\n")
+	ticker := time.NewTicker(1 * time.Second)
+
+	var wg sync.WaitGroup
+	defer func() {
+		ticker.Stop()
+		wg.Wait()
+		close(stopped)
+	}()
+
 	for {
-		time.Sleep(1 * time.Second)
-		go registerNode()
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				registerNode()
+			}()
+		}
 	}
 }
 
-func ab(n, c, u string) ([]byte, error) {
-	args := []string{"-l", "-n", n, "-c", c, "-v", "2", "-q", u}
-	cmd := "ab"
-	return exec.Command(cmd, args...).Output()
-}
-
 func indexHandler(w http.ResponseWriter, r *http.Request) {
-	token := r.URL.Query().Get("token")
-	n := r.URL.Query().Get("n")
-	c := r.URL.Query().Get("c")
-	urltohit := r.URL.Query().Get("url")
-
-	if len(n) == 0 {
-		apitools.Error(w, errors.New("n request variable not set"))
+	lr, err := loadRequest(r)
+	if err != nil {
+		apitools.Error(w, err)
 		return
 	}
 
-	if len(c) == 0 {
-		apitools.Error(w, errors.New("c request variable not set"))
-		return
-	}
+	token := lr.Token
+	urltohit := lr.URL
 
 	if len(urltohit) == 0 {
 		apitools.Error(w, errors.New("url request variable not set"))
 		return
 	}
 
-	ok := verifyURL(urltohit)
-	if !ok {
-		apitools.Error(w, errors.New("only in registered generators can be used - no ddosing"))
+	spec, err := loadSpec(lr)
+	if err != nil {
+		apitools.Error(w, err)
 		return
 	}
 
-	urltohit += "?token=" + token
+	engineName := lr.Engine
+	if len(engineName) == 0 {
+		engineName = defaultEngine
+		// Only the native engine can hold a rate or follow a profile, and
+		// ab stops at 50000 requests when it is only given a duration.
+		timed := spec.N == 0 && (spec.Duration > 0 || !spec.Deadline.IsZero())
+		if spec.QPS > 0 || len(spec.Profile) > 0 || timed {
+			engineName = loadgen.EngineNative
+		}
+	}
 
-	active = true
-	if err := cache.RegisterGenerator(nodeID, selfHostName, active); err != nil {
+	engine, err := loadgen.NewEngine(engineName)
+	if err != nil {
 		apitools.Error(w, err)
 		return
 	}
 
-	fmt.Printf("sending load to %s \n", urltohit)
-	results, err := ab(n, c, urltohit)
-	if err != nil {
-		if err.Error() == "exit status 22" {
-			fmt.Printf("urltohit: %s\n", urltohit)
-			fmt.Printf("results: %s\n", results)
-			fmt.Printf("error: %s\n", err)
-			apitools.Error(w, fmt.Errorf("might be an issue with env variable `urltohit=%s` ", urltohit))
+	if rejection := verifyURL(urltohit); rejection != nil {
+		runsTotal.With(engineName, caching.ABRejected).Inc()
+		msg := caching.ABResponse{Token: token, IP: selfHostName, Status: caching.ABRejected, Error: rejection.Error(), Rejection: rejection}
+		json, err := msg.JSON()
+		if err != nil {
+			apitools.Error(w, err)
 			return
 		}
-		apitools.Error(w, err)
+		apitools.Respond(w, http.StatusForbidden, json)
 		return
 	}
-	fmt.Printf("load sent\n")
-	fmt.Printf("%s\n", results)
 
-	active = false
-	if err := cache.RegisterGenerator(nodeID, selfHostName, active); err != nil {
+	urltohit, err = withToken(urltohit, token)
+	if err != nil {
 		apitools.Error(w, err)
 		return
 	}
+	spec.URL = urltohit
+
+	// The visualizer drops the connection when its deadline passes or the
+	// run is cancelled, which cancels the request context and stops the load.
+	// An abort cancels it too.
+	ctx, release, err := runs.acquire(r.Context(), lr.Job)
+	switch {
+	case err == errBusy:
+		runsTotal.With(engineName, caching.ABBusy).Inc()
+		msg := caching.ABResponse{Token: token, IP: selfHostName, Status: caching.ABBusy, Error: err.Error()}
+		json, err := msg.JSON()
+		if err != nil {
+			apitools.Error(w, err)
+			return
+		}
+		apitools.Respond(w, http.StatusServiceUnavailable, json)
+		return
+	case err == errAborted:
+		runsTotal.With(engineName, caching.ABAborted).Inc()
+		msg := caching.ABResponse{Token: token, IP: selfHostName, Status: caching.ABAborted, Error: err.Error()}
+		apitools.JSON(w, msg)
+		return
+	case err != nil:
+		runsTotal.With(engineName, caching.ABCancelled).Inc()
+		apitools.Error(w, fmt.Errorf("load cancelled while queued: %s", err))
+		return
+	}
+	defer publishState()
+	defer release()
+
+	publishState()
+
+	// Progress keeps the metrics current during long runs, as well as
+	// letting the visualizer follow a job.
+	live := &runMetrics{engine: engineName}
+	spec.Progress = func(s loadgen.Snapshot) {
+		live.progress(s)
+		if len(lr.Job) > 0 {
+			publishProgress(lr.Job, s, false)
+		}
+	}
 
-	if err := writeLog(results, token); err != nil {
+	fmt.Printf("sending load to %s with %s\n", urltohit, engineName)
+	result, err := engine.Run(ctx, spec)
+	results := result.Output
+
+	// Runs without a token are logged against their job instead.
+	logKey := token
+	if len(logKey) == 0 {
+		logKey = lr.Job
+	}
+
+	if len(results) > 0 {
+		if err := logSink.SaveLog(logKey, selfHostName, results); err != nil {
+			sdlog("could not save run log", err)
+		}
+	}
+
+	if len(lr.Job) > 0 {
+		final := loadgen.Snapshot{
+			Sent:   result.Stats.Complete,
+			Errors: result.Stats.Failed + result.Stats.Non2xx,
+		}
+		publishProgress(lr.Job, final, true)
+	}
+	if err != nil {
+		if r.Context().Err() != nil {
+			fmt.Printf("load to %s cancelled: %s\n", urltohit, r.Context().Err())
+			live.finish(caching.ABCancelled, result)
+			apitools.Error(w, fmt.Errorf("load cancelled: %s", r.Context().Err()))
+			return
+		}
+
+		if ctx.Err() != nil {
+			fmt.Printf("load to %s aborted\n", urltohit)
+			live.finish(caching.ABAborted, result)
+			msg := caching.ABResponse{Token: token, IP: selfHostName, Status: caching.ABAborted, Error: "load aborted", Stats: &result.Stats}
+			apitools.JSON(w, msg)
+			return
+		}
+
+		fmt.Printf("results: %s\n", results)
+		live.finish(caching.ABError, result)
 		apitools.Error(w, err)
 		return
 	}
+	fmt.Printf("load sent\n")
+	fmt.Printf("%s\n", results)
+	live.finish(caching.ABSuccess, result)
 
-	msg := caching.ABResponse{Token: token, IP: r.RemoteAddr, Status: "success"}
+	msg := caching.ABResponse{Token: token, IP: selfHostName, Status: caching.ABSuccess, Stats: &result.Stats}
 	apitools.JSON(w, msg)
 	return
 
 }
 
-func writeLog(data []byte, token string) error {
-	name := fmt.Sprintf("/go/src/generator/logs/log_%s.log", token)
-	return ioutil.WriteFile(name, data, 0644)
+// publishProgress stores how far along a job's load this generator is, for
+// the visualizer to stream.
+func publishProgress(job string, s loadgen.Snapshot, done bool) {
+	p := caching.Progress{
+		Job:           job,
+		IP:            selfHostName,
+		Sent:          s.Sent,
+		Errors:        s.Errors,
+		Rate:          s.Rate,
+		MeanLatencyMS: float64(s.MeanLatency) / float64(time.Millisecond),
+		MaxLatencyMS:  float64(s.MaxLatency) / float64(time.Millisecond),
+		Done:          done,
+	}
+
+	if err := cache.RecordProgress(p); err != nil {
+		sdlog("could not record progress", err)
+	}
 }
 
-func getHostIP() (string, error) {
-	client := metadata.NewClient(&http.Client{
-		Transport: userAgentTransport{
-			userAgent: "loadgenerator",
-			base:      http.DefaultTransport,
-		},
-		Timeout: 1 * time.Second})
+// loadRequest reads the load a caller wants. The visualizer posts it as JSON,
+// but the request variables still work for a simple run by hand.
+func loadRequest(r *http.Request) (caching.LoadRequest, error) {
+	lr := caching.LoadRequest{}
 
-	return client.ExternalIP()
-}
+	if r.Method == http.MethodPost {
+		err := lr.Load(r.Body)
+		return lr, err
+	}
 
-// userAgentTransport sets the User-Agent header before calling base.
-type userAgentTransport struct {
-	userAgent string
-	base      http.RoundTripper
+	q := r.URL.Query()
+	lr.N = q.Get("n")
+	lr.C = q.Get("c")
+	lr.URL = q.Get("url")
+	lr.Token = q.Get("token")
+	lr.QPS = q.Get("qps")
+	lr.Duration = q.Get("duration")
+	lr.Engine = q.Get("engine")
+	lr.KeepAlive = q.Get("keepalive") == "true"
+
+	return lr, nil
 }
 
-// RoundTrip implements the http.RoundTripper interface.
-func (t userAgentTransport) RoundTrip(req *http.Request) (*http.Response, error) {
-	req.Header.Set("User-Agent", t.userAgent)
-	return t.base.RoundTrip(req)
+// loadSpec works out the shape of the load: a profile of stages, qps and
+// duration for a constant rate, or c with n, duration or both for a closed
+// loop.
+func loadSpec(lr caching.LoadRequest) (loadgen.Spec, error) {
+	spec := loadgen.Spec{StartAt: lr.StartAt, Deadline: lr.Deadline, KeepAlive: lr.KeepAlive}
+
+	if lr.Request != nil {
+		tmpl, err := loadgen.NewTemplate(*lr.Request)
+		if err != nil {
+			return spec, err
+		}
+		spec.Request = tmpl
+	}
+
+	if len(lr.Profile) > 0 {
+		p, err := loadgen.NewProfile(lr.Profile)
+		if err != nil {
+			return spec, err
+		}
+		spec.Profile = p
+
+		return spec, nil
+	}
+
+	if len(lr.Duration) > 0 {
+		d, err := time.ParseDuration(lr.Duration)
+		if err != nil || d <= 0 {
+			return spec, fmt.Errorf("duration request variable is not a duration: %s", lr.Duration)
+		}
+		spec.Duration = d
+	}
+
+	if len(lr.QPS) > 0 {
+		rate, err := strconv.ParseFloat(lr.QPS, 64)
+		if err != nil || rate <= 0 {
+			return spec, fmt.Errorf("qps request variable is not a positive number: %s", lr.QPS)
+		}
+		spec.QPS = rate
+
+		if spec.Duration == 0 {
+			return spec, errors.New("duration request variable not set")
+		}
+
+		if len(lr.C) > 0 {
+			cInt, err := strconv.Atoi(lr.C)
+			if err != nil {
+				return spec, fmt.Errorf("c request variable is not a number: %s", lr.C)
+			}
+			spec.C = cInt
+		}
+
+		return spec, nil
+	}
+
+	if len(lr.N) == 0 && spec.Duration == 0 {
+		return spec, errors.New("n or duration request variable not set")
+	}
+
+	if len(lr.C) == 0 {
+		return spec, errors.New("c request variable not set")
+	}
+
+	if len(lr.N) > 0 {
+		nInt, err := strconv.Atoi(lr.N)
+		if err != nil {
+			return spec, fmt.Errorf("n request variable is not a number: %s", lr.N)
+		}
+		spec.N = nInt
+	}
+
+	cInt, err := strconv.Atoi(lr.C)
+	if err != nil {
+		return spec, fmt.Errorf("c request variable is not a number: %s", lr.C)
+	}
+	spec.C = cInt
+
+	return spec, nil
 }
 
 func sdlog(msg string, err error) {
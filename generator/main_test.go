@@ -0,0 +1,28 @@
+package main
+
+import "testing"
+
+func TestWithToken(t *testing.T) {
+	cases := []struct {
+		name   string
+		target string
+		want   string
+	}{
+		{"no query", "http://receiver:8080/record", "http://receiver:8080/record?token=abc"},
+		{"existing query", "http://receiver:8080/record?env=gke", "http://receiver:8080/record?env=gke&token=abc"},
+		{"existing token", "http://receiver:8080/record?token=old", "http://receiver:8080/record?token=abc"},
+		{"fragment", "http://receiver:8080/record#top", "http://receiver:8080/record?token=abc#top"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := withToken(tc.target, "abc")
+			if err != nil {
+				t.Fatalf("withToken() got error: %s", err)
+			}
+			if got != tc.want {
+				t.Errorf("withToken() = %s, want %s", got, tc.want)
+			}
+		})
+	}
+}
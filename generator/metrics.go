@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/tpryan/scaling/loadgen"
+	"github.com/tpryan/scaling/metrics"
+)
+
+var (
+	registry = metrics.NewRegistry()
+
+	runsTotal = registry.NewCounter("generator_runs_total",
+		"Load runs handled, by engine and how they ended.", "engine", "status")
+	runsActive = registry.NewGauge("generator_runs_active",
+		"Load runs going right now.")
+	runsQueued = registry.NewGauge("generator_runs_queued",
+		"Load runs waiting for the current one to finish.")
+	requestsSent = registry.NewCounter("generator_requests_sent_total",
+		"Requests sent to targets, by engine.", "engine")
+	requestErrors = registry.NewCounter("generator_request_errors_total",
+		"Requests that failed or got a non 2xx response, by engine.", "engine")
+	requestLatency = registry.NewHistogram("generator_request_latency_seconds",
+		"Latency of requests sent to targets, by engine, added as each run finishes.", metrics.DefaultBuckets, "engine")
+)
+
+// runMetrics keeps the request counters up to date while a run goes, from
+// its progress snapshots. Snapshots carry no latencies, so the latency
+// histogram is only filled in once the run is over.
+type runMetrics struct {
+	engine string
+
+	mu     sync.Mutex
+	sent   int
+	errors int
+}
+
+// progress counts the requests sent since the last snapshot.
+func (m *runMetrics) progress(s loadgen.Snapshot) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.count(s.Sent, s.Errors)
+}
+
+// count brings the counters up to the given run totals. Totals never go
+// down, so a snapshot that arrives late is ignored.
+func (m *runMetrics) count(sent, errors int) {
+	if sent > m.sent {
+		requestsSent.With(m.engine).Add(float64(sent - m.sent))
+		m.sent = sent
+	}
+	if errors > m.errors {
+		requestErrors.With(m.engine).Add(float64(errors - m.errors))
+		m.errors = errors
+	}
+}
+
+// finish counts a finished run, the requests it sent that no snapshot had
+// counted yet, and the latency of every request.
+func (m *runMetrics) finish(status string, result loadgen.Result) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	runsTotal.With(m.engine, status).Inc()
+
+	stats := result.Stats
+	m.count(stats.Complete, stats.Failed+stats.Non2xx)
+
+	if stats.Histogram == nil {
+		return
+	}
+
+	latency := requestLatency.With(m.engine)
+	stats.Histogram.Each(func(d time.Duration, count int64) {
+		latency.ObserveN(d.Seconds(), uint64(count))
+	})
+}
+
+// recordQueue brings the run gauges up to date with the queue.
+func recordQueue() {
+	busy, _, waiting := runs.status()
+
+	active := 0.0
+	if busy {
+		active = 1
+	}
+
+	runsActive.With().Set(active)
+	runsQueued.With().Set(float64(waiting))
+}
+
+// handleMetrics serves the generator's metrics in the Prometheus text format.
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	recordQueue()
+	registry.Handler()(w, r)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tpryan/scaling/caching"
+	"github.com/tpryan/scaling/loadgen"
+)
+
+// scrape returns the metrics lines for the test engine.
+func scrape(t *testing.T) string {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	handleMetrics(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	lines := []string{}
+	for _, l := range strings.Split(w.Body.String(), "\n") {
+		if strings.Contains(l, `engine="test"`) && !strings.Contains(l, "_bucket") {
+			lines = append(lines, l)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+func TestRunMetrics(t *testing.T) {
+	m := &runMetrics{engine: "test"}
+
+	m.progress(loadgen.Snapshot{Sent: 10, Errors: 1})
+	m.progress(loadgen.Snapshot{Sent: 25, Errors: 1})
+
+	got := scrape(t)
+	for _, want := range []string{
+		`generator_requests_sent_total{engine="test"} 25`,
+		`generator_request_errors_total{engine="test"} 1`,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("metrics during the run = %q, want %q", got, want)
+		}
+	}
+
+	h := caching.NewHistogram()
+	for i := 0; i < 30; i++ {
+		h.Record(10 * time.Millisecond)
+	}
+	m.finish(caching.ABSuccess, loadgen.Result{Stats: caching.LoadStats{Complete: 30, Failed: 1, Non2xx: 2, Histogram: h}})
+
+	// A snapshot that arrives after the run is over doesn't count twice.
+	m.progress(loadgen.Snapshot{Sent: 28, Errors: 2})
+
+	got = scrape(t)
+	for _, want := range []string{
+		`generator_requests_sent_total{engine="test"} 30`,
+		`generator_request_errors_total{engine="test"} 3`,
+		`generator_runs_total{engine="test",status="success"} 1`,
+		`generator_request_latency_seconds_count{engine="test"} 30`,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("metrics after the run = %q, want %q", got, want)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+var (
+	errBusy    = errors.New("generator is busy with another run and its queue is full")
+	errAborted = errors.New("run aborted while queued")
+)
+
+// ticket is a run waiting in the queue. It is sent true when the run can
+// start, or false if it is aborted first. The run's context is made when it
+// is handed over, so it can be aborted before its goroutine wakes up.
+type ticket struct {
+	job    string
+	parent context.Context
+	ready  chan bool
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// runQueue makes sure that only one run happens at a time. Runs that arrive
+// while one is going wait their turn, up to depth of them, and any more are
+// turned away.
+type runQueue struct {
+	mu      sync.Mutex
+	depth   int
+	busy    bool
+	job     string
+	cancel  context.CancelFunc
+	waiting []*ticket
+}
+
+// acquire waits until a run for the job can start. The returned context is
+// cancelled if the run is aborted, and release has to be called once the run
+// is over.
+func (q *runQueue) acquire(parent context.Context, job string) (context.Context, func(), error) {
+	q.mu.Lock()
+
+	if q.busy {
+		if len(q.waiting) >= q.depth {
+			q.mu.Unlock()
+			return nil, nil, errBusy
+		}
+
+		t := &ticket{job: job, parent: parent, ready: make(chan bool, 1)}
+		q.waiting = append(q.waiting, t)
+		q.mu.Unlock()
+
+		ok := false
+		select {
+		case ok = <-t.ready:
+		case <-parent.Done():
+			q.mu.Lock()
+			removed := q.remove(t)
+			q.mu.Unlock()
+
+			// Too late to leave quietly, the run was already handed over.
+			if !removed && <-t.ready {
+				t.cancel()
+				q.release()
+			}
+			return nil, nil, parent.Err()
+		}
+
+		if !ok {
+			return nil, nil, errAborted
+		}
+
+		return t.ctx, q.done(t.cancel), nil
+	}
+
+	ctx, cancel := context.WithCancel(parent)
+	q.busy = true
+	q.job, q.cancel = job, cancel
+	q.mu.Unlock()
+
+	return ctx, q.done(cancel), nil
+}
+
+// done returns the function that ends a run.
+func (q *runQueue) done(cancel context.CancelFunc) func() {
+	return func() {
+		cancel()
+		q.release()
+	}
+}
+
+// release ends the current run, handing over to the next in the queue.
+func (q *runQueue) release() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.job, q.cancel = "", nil
+
+	if len(q.waiting) == 0 {
+		q.busy = false
+		return
+	}
+
+	// The next run becomes the current one while the lock is still held,
+	// so there is never a moment where a run is going that abort can't
+	// reach.
+	t := q.waiting[0]
+	q.waiting = q.waiting[1:]
+	t.ctx, t.cancel = context.WithCancel(t.parent)
+	q.job, q.cancel = t.job, t.cancel
+	t.ready <- true
+}
+
+// abort cancels the current run, and any queued ones, for a job. An empty job
+// matches only the current run, whatever it is. It reports whether anything
+// was aborted.
+func (q *runQueue) abort(job string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	aborted := false
+
+	if q.cancel != nil && (len(job) == 0 || job == q.job) {
+		q.cancel()
+		aborted = true
+	}
+
+	if len(job) == 0 {
+		return aborted
+	}
+
+	for _, t := range append([]*ticket{}, q.waiting...) {
+		if t.job == job {
+			q.remove(t)
+			t.ready <- false
+			aborted = true
+		}
+	}
+
+	return aborted
+}
+
+// abortAll cancels the current run and every queued one.
+func (q *runQueue) abortAll() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.cancel != nil {
+		q.cancel()
+	}
+
+	for _, t := range q.waiting {
+		t.ready <- false
+	}
+	q.waiting = nil
+}
+
+// remove takes a ticket out of the queue, reporting whether it was there.
+// The caller must hold the lock.
+func (q *runQueue) remove(t *ticket) bool {
+	for i, w := range q.waiting {
+		if w == t {
+			q.waiting = append(q.waiting[:i], q.waiting[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// status reports whether a run is going, which job it belongs to, and how
+// many runs are waiting.
+func (q *runQueue) status() (bool, string, int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.busy, q.job, len(q.waiting)
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// acquired is what a queued acquire came back with.
+type acquired struct {
+	job     string
+	ctx     context.Context
+	release func()
+	err     error
+}
+
+// enqueue starts an acquire for job in the background, and waits until it
+// is in the queue, so that runs queue up in the order they are enqueued.
+func enqueue(t *testing.T, q *runQueue, parent context.Context, job string) chan acquired {
+	t.Helper()
+
+	_, _, before := q.status()
+
+	out := make(chan acquired, 1)
+	go func() {
+		ctx, release, err := q.acquire(parent, job)
+		out <- acquired{job, ctx, release, err}
+	}()
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		if _, _, waiting := q.status(); waiting > before {
+			return out
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("run for %s never joined the queue", job)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func receive(t *testing.T, out chan acquired) acquired {
+	t.Helper()
+
+	select {
+	case a := <-out:
+		return a
+	case <-time.After(time.Second):
+		t.Fatalf("acquire never returned")
+	}
+	return acquired{}
+}
+
+func TestRunQueueOrder(t *testing.T) {
+	q := &runQueue{depth: 3}
+
+	_, release, err := q.acquire(context.Background(), "first")
+	if err != nil {
+		t.Fatalf("acquire() got error: %s", err)
+	}
+
+	queued := []chan acquired{}
+	for _, job := range []string{"a", "b", "c"} {
+		queued = append(queued, enqueue(t, q, context.Background(), job))
+	}
+
+	if busy, job, waiting := q.status(); !busy || job != "first" || waiting != 3 {
+		t.Errorf("status() = %t, %s, %d, want true, first, 3", busy, job, waiting)
+	}
+
+	for i, job := range []string{"a", "b", "c"} {
+		release()
+
+		a := receive(t, queued[i])
+		if a.err != nil {
+			t.Fatalf("acquire(%s) got error: %s", job, a.err)
+		}
+		if a.job != job {
+			t.Errorf("run %d was %s, want %s", i, a.job, job)
+		}
+		if _, current, _ := q.status(); current != job {
+			t.Errorf("status() job = %s, want %s", current, job)
+		}
+		release = a.release
+	}
+
+	release()
+	if busy, job, waiting := q.status(); busy || job != "" || waiting != 0 {
+		t.Errorf("status() after the last run = %t, %q, %d, want idle", busy, job, waiting)
+	}
+}
+
+func TestRunQueueFull(t *testing.T) {
+	q := &runQueue{depth: 1}
+
+	_, release, err := q.acquire(context.Background(), "first")
+	if err != nil {
+		t.Fatalf("acquire() got error: %s", err)
+	}
+	queued := enqueue(t, q, context.Background(), "second")
+
+	if _, _, err := q.acquire(context.Background(), "third"); err != errBusy {
+		t.Errorf("acquire() on a full queue got error %v, want %s", err, errBusy)
+	}
+
+	release()
+	a := receive(t, queued)
+	if a.err != nil {
+		t.Fatalf("acquire() got error: %s", a.err)
+	}
+	a.release()
+}
+
+func TestRunQueueNoDepth(t *testing.T) {
+	q := &runQueue{}
+
+	_, release, err := q.acquire(context.Background(), "first")
+	if err != nil {
+		t.Fatalf("acquire() got error: %s", err)
+	}
+	defer release()
+
+	if _, _, err := q.acquire(context.Background(), "second"); err != errBusy {
+		t.Errorf("acquire() with no queue got error %v, want %s", err, errBusy)
+	}
+}
+
+func TestRunQueueAbortQueued(t *testing.T) {
+	q := &runQueue{depth: 2}
+
+	ctx, release, err := q.acquire(context.Background(), "first")
+	if err != nil {
+		t.Fatalf("acquire() got error: %s", err)
+	}
+	aborted := enqueue(t, q, context.Background(), "doomed")
+	kept := enqueue(t, q, context.Background(), "kept")
+
+	if !q.abort("doomed") {
+		t.Errorf("abort() of a queued run reported nothing aborted")
+	}
+
+	if a := receive(t, aborted); a.err != errAborted {
+		t.Errorf("acquire() of an aborted run got error %v, want %s", a.err, errAborted)
+	}
+	if ctx.Err() != nil {
+		t.Errorf("abort() of a queued run cancelled the current one")
+	}
+	if _, _, waiting := q.status(); waiting != 1 {
+		t.Errorf("status() waiting = %d, want 1", waiting)
+	}
+
+	if q.abort("unknown") {
+		t.Errorf("abort() of an unknown job reported something aborted")
+	}
+
+	release()
+	a := receive(t, kept)
+	if a.err != nil || a.job != "kept" {
+		t.Fatalf("acquire() got %s, %v, want kept to run", a.job, a.err)
+	}
+	a.release()
+}
+
+func TestRunQueueAbortCurrent(t *testing.T) {
+	q := &runQueue{depth: 1}
+
+	ctx, release, err := q.acquire(context.Background(), "first")
+	if err != nil {
+		t.Fatalf("acquire() got error: %s", err)
+	}
+	queued := enqueue(t, q, context.Background(), "second")
+
+	// An empty job matches the current run but leaves the queue alone.
+	if !q.abort("") {
+		t.Errorf("abort() of the current run reported nothing aborted")
+	}
+	if ctx.Err() == nil {
+		t.Errorf("abort() did not cancel the current run")
+	}
+	if _, _, waiting := q.status(); waiting != 1 {
+		t.Errorf("status() waiting = %d, want the queued run kept", waiting)
+	}
+
+	release()
+	a := receive(t, queued)
+	if a.err != nil || a.ctx.Err() != nil {
+		t.Fatalf("acquire() got %v, want the queued run to start", a.err)
+	}
+	a.release()
+}
+
+func TestRunQueueAbortDuringHandoff(t *testing.T) {
+	q := &runQueue{depth: 1}
+
+	_, release, err := q.acquire(context.Background(), "first")
+	if err != nil {
+		t.Fatalf("acquire() got error: %s", err)
+	}
+	queued := enqueue(t, q, context.Background(), "second")
+
+	// The queued run is handed over, but its goroutine has not necessarily
+	// woken up yet. Aborting it now must still stop it.
+	release()
+	if busy, job, _ := q.status(); !busy || job != "second" {
+		t.Errorf("status() after the handoff = %t, %s, want true, second", busy, job)
+	}
+	if !q.abort("second") {
+		t.Errorf("abort() during the handoff reported nothing aborted")
+	}
+
+	a := receive(t, queued)
+	if a.err != nil {
+		t.Fatalf("acquire() got error: %s", a.err)
+	}
+	if a.ctx.Err() == nil {
+		t.Errorf("run aborted during the handoff was not cancelled")
+	}
+
+	a.release()
+	if busy, _, _ := q.status(); busy {
+		t.Errorf("status() after the aborted run = busy, want idle")
+	}
+}
+
+func TestRunQueueAbortAll(t *testing.T) {
+	q := &runQueue{depth: 2}
+
+	ctx, release, err := q.acquire(context.Background(), "first")
+	if err != nil {
+		t.Fatalf("acquire() got error: %s", err)
+	}
+	queued := []chan acquired{
+		enqueue(t, q, context.Background(), "a"),
+		enqueue(t, q, context.Background(), "b"),
+	}
+
+	q.abortAll()
+
+	if ctx.Err() == nil {
+		t.Errorf("abortAll() did not cancel the current run")
+	}
+	for _, out := range queued {
+		if a := receive(t, out); a.err != errAborted {
+			t.Errorf("acquire(%s) got error %v, want %s", a.job, a.err, errAborted)
+		}
+	}
+
+	release()
+	if busy, _, waiting := q.status(); busy || waiting != 0 {
+		t.Errorf("status() after abortAll() = %t, %d, want idle", busy, waiting)
+	}
+}
+
+func TestRunQueueParentCancelled(t *testing.T) {
+	q := &runQueue{depth: 1}
+
+	_, release, err := q.acquire(context.Background(), "first")
+	if err != nil {
+		t.Fatalf("acquire() got error: %s", err)
+	}
+
+	parent, cancel := context.WithCancel(context.Background())
+	queued := enqueue(t, q, parent, "second")
+	cancel()
+
+	if a := receive(t, queued); a.err != context.Canceled {
+		t.Errorf("acquire() got error %v, want %s", a.err, context.Canceled)
+	}
+	if _, _, waiting := q.status(); waiting != 0 {
+		t.Errorf("status() waiting = %d, want the cancelled run gone", waiting)
+	}
+
+	release()
+	if busy, _, _ := q.status(); busy {
+		t.Errorf("status() after the last run = busy, want idle")
+	}
+}
@@ -0,0 +1,334 @@
+// Package loadgen holds the pieces of the generator that produce load and
+// make sense of the results.
+package loadgen
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tpryan/scaling/caching"
+)
+
+// AB is the engine that shells out to Apache Bench. It needs the ab binary,
+// which comes from apache2-utils, on the path.
+type AB struct{}
+
+// Run runs Apache Bench, killing it if ctx is cancelled before it finishes.
+// A run bounded by time is passed to ab as -t, which caps it at 50000
+// requests unless n is also set, so runs bounded only by time are refused
+// rather than quietly cut short.
+func (a AB) Run(ctx context.Context, spec Spec) (Result, error) {
+	result := Result{}
+
+	if spec.QPS > 0 || len(spec.Profile) > 0 {
+		return result, fmt.Errorf("the ab engine can only keep a fixed concurrency, use the %s engine", EngineNative)
+	}
+
+	if spec.N == 0 {
+		return result, fmt.Errorf("the ab engine needs n to bound a run, even with a duration, use the %s engine", EngineNative)
+	}
+
+	if !waitUntil(ctx, spec.StartAt) {
+		return result, ctx.Err()
+	}
+
+	args := []string{"-l"}
+
+	// ab resets n when it sees -t, so the time limit has to come first.
+	if deadline := spec.deadline(time.Now()); !deadline.IsZero() {
+		seconds := int(math.Ceil(time.Until(deadline).Seconds()))
+		if seconds < 1 {
+			seconds = 1
+		}
+		args = append(args, "-t", strconv.Itoa(seconds))
+	}
+
+	args = append(args, "-n", strconv.Itoa(spec.N))
+
+	if spec.KeepAlive {
+		args = append(args, "-k")
+	}
+
+	shape, cleanup, err := abRequestArgs(spec.Request)
+	if err != nil {
+		return result, err
+	}
+	defer cleanup()
+	args = append(args, shape...)
+
+	// ab writes the time of every request to the -g file, which is turned
+	// into a histogram that can be merged with other generators'.
+	timings, err := ioutil.TempFile("", "ab-timings-")
+	if err != nil {
+		return result, fmt.Errorf("could not create timings file: %s", err)
+	}
+	timings.Close()
+	defer os.Remove(timings.Name())
+	args = append(args, "-g", timings.Name())
+
+	c := strconv.Itoa(spec.C)
+	args = append(args, "-c", c, "-v", "2", spec.URL)
+
+	var stdout bytes.Buffer
+	cmd := exec.CommandContext(ctx, "ab", args...)
+	cmd.Stdout = &stdout
+
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return result, fmt.Errorf("could not read ab progress: %s", err)
+	}
+
+	if err := cmd.Start(); err != nil {
+		return result, err
+	}
+
+	abProgress(stderr, spec.Progress)
+
+	err = cmd.Wait()
+	out := stdout.Bytes()
+	result.Output = out
+	if err != nil {
+		if err.Error() == "exit status 22" {
+			return result, fmt.Errorf("might be an issue with url `%s`: %s", spec.URL, err)
+		}
+		return result, err
+	}
+
+	stats, err := ParseAB(out)
+	if err != nil {
+		return result, err
+	}
+
+	f, err := os.Open(timings.Name())
+	if err != nil {
+		return result, fmt.Errorf("could not read timings file: %s", err)
+	}
+	defer f.Close()
+
+	stats.Histogram, err = ParseABTimings(f)
+	if err != nil {
+		return result, err
+	}
+	result.Stats = stats
+
+	return result, nil
+}
+
+// abProgress reads the "Completed N requests" lines that ab writes to stderr
+// as it goes, every tenth of the run, and passes them on as snapshots. It
+// returns once stderr is closed. Errors are only known at the end of the
+// run, so snapshots only count requests sent.
+func abProgress(stderr io.Reader, progress func(Snapshot)) {
+	last, lastAt := 0, time.Now()
+
+	scanner := bufio.NewScanner(stderr)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if progress == nil || len(fields) != 3 || fields[0] != "Completed" || fields[2] != "requests" {
+			continue
+		}
+
+		sent, err := strconv.Atoi(fields[1])
+		if err != nil {
+			continue
+		}
+
+		now := time.Now()
+		s := Snapshot{Sent: sent}
+		if elapsed := now.Sub(lastAt); elapsed > 0 {
+			s.Rate = float64(sent-last) / elapsed.Seconds()
+		}
+		last, lastAt = sent, now
+
+		progress(s)
+	}
+
+	// Keep draining so ab never blocks on a full pipe.
+	io.Copy(ioutil.Discard, stderr)
+}
+
+// abRequestArgs turns a request template into ab flags. ab reads a body
+// from a file, so one is written for the run and cleanup removes it. ab can
+// only send a body with POST or PUT.
+func abRequestArgs(t Template) ([]string, func(), error) {
+	args := []string{}
+	cleanup := func() {}
+
+	for k, vs := range t.Header {
+		// ab takes the content type of a body as its own flag.
+		if k == "Content-Type" && len(t.Body) > 0 {
+			continue
+		}
+		for _, v := range vs {
+			args = append(args, "-H", fmt.Sprintf("%s: %s", k, v))
+		}
+	}
+
+	if len(t.Body) == 0 {
+		if len(t.Method) > 0 && t.Method != http.MethodGet {
+			args = append(args, "-m", t.Method)
+		}
+		return args, cleanup, nil
+	}
+
+	flag := ""
+	switch t.Method {
+	case http.MethodPost:
+		flag = "-p"
+	case http.MethodPut:
+		flag = "-u"
+	default:
+		return args, cleanup, fmt.Errorf("the ab engine can only send a body with POST or PUT, use the %s engine", EngineNative)
+	}
+
+	f, err := ioutil.TempFile("", "ab-body-")
+	if err != nil {
+		return args, cleanup, fmt.Errorf("could not write request body: %s", err)
+	}
+	cleanup = func() { os.Remove(f.Name()) }
+
+	if _, err := f.Write(t.Body); err != nil {
+		f.Close()
+		cleanup()
+		return args, func() {}, fmt.Errorf("could not write request body: %s", err)
+	}
+	f.Close()
+
+	contentType := t.Header.Get("Content-Type")
+	if len(contentType) == 0 {
+		contentType = "text/plain"
+	}
+
+	args = append(args, flag, f.Name(), "-T", contentType)
+
+	return args, cleanup, nil
+}
+
+// ParseAB turns the report that Apache Bench prints at the end of a run into
+// structured statistics. Lines it does not recognise, like the per request
+// logging of -v 2, are skipped.
+func ParseAB(output []byte) (caching.LoadStats, error) {
+	stats := caching.LoadStats{Percentiles: map[string]float64{}}
+	found := false
+	inPercentiles := false
+
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		if inPercentiles {
+			fields := strings.Fields(line)
+			if len(fields) >= 2 && strings.HasSuffix(fields[0], "%") {
+				ms, err := strconv.ParseFloat(fields[1], 64)
+				if err != nil {
+					return stats, fmt.Errorf("could not parse percentile %q: %s", line, err)
+				}
+				stats.Percentiles["p"+strings.TrimSuffix(fields[0], "%")] = ms
+				continue
+			}
+			inPercentiles = false
+		}
+
+		if strings.HasPrefix(line, "Percentage of the requests served") {
+			inPercentiles = true
+			continue
+		}
+
+		label, value, ok := abField(line)
+		if !ok {
+			continue
+		}
+
+		var err error
+		switch label {
+		case "Complete requests":
+			stats.Complete, err = strconv.Atoi(value)
+			found = true
+		case "Failed requests":
+			stats.Failed, err = strconv.Atoi(value)
+		case "Non-2xx responses":
+			stats.Non2xx, err = strconv.Atoi(value)
+		case "Requests per second":
+			stats.RequestsPerSecond, err = strconv.ParseFloat(value, 64)
+		case "Transfer rate":
+			stats.TransferRateKBps, err = strconv.ParseFloat(value, 64)
+		case "Time taken for tests":
+			stats.DurationSeconds, err = strconv.ParseFloat(value, 64)
+		case "Time per request":
+			// ab prints this twice, the first is the latency of a single
+			// request, the second is averaged across concurrent requests.
+			if stats.MeanLatencyMS == 0 {
+				stats.MeanLatencyMS, err = strconv.ParseFloat(value, 64)
+			}
+		}
+		if err != nil {
+			return stats, fmt.Errorf("could not parse %q: %s", line, err)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return stats, err
+	}
+
+	if !found {
+		return stats, fmt.Errorf("could not find a report in the ab output")
+	}
+
+	return stats, nil
+}
+
+// abField splits a report line like "Complete requests:      1000" into its
+// label and the first word of its value.
+func abField(line string) (string, string, bool) {
+	i := strings.Index(line, ":")
+	if i < 0 {
+		return "", "", false
+	}
+
+	fields := strings.Fields(line[i+1:])
+	if len(fields) == 0 {
+		return "", "", false
+	}
+
+	return line[:i], fields[0], true
+}
+
+// ParseABTimings reads the file that ab writes with -g, which has a tab
+// separated line per request, into a histogram of the total time of each. ab
+// only records whole milliseconds.
+func ParseABTimings(r io.Reader) (*caching.Histogram, error) {
+	h := caching.NewHistogram()
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), "\t")
+		if len(fields) < 6 || fields[0] == "starttime" {
+			continue
+		}
+
+		ttime, err := strconv.Atoi(strings.TrimSpace(fields[4]))
+		if err != nil {
+			return nil, fmt.Errorf("could not parse timing %q: %s", scanner.Text(), err)
+		}
+		h.Record(time.Duration(ttime) * time.Millisecond)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("could not read timings: %s", err)
+	}
+
+	return h, nil
+}
@@ -0,0 +1,178 @@
+package loadgen
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tpryan/scaling/caching"
+)
+
+func TestParseAB(t *testing.T) {
+	cases := []struct {
+		name string
+		file string
+		want caching.LoadStats
+	}{
+		{
+			name: "ok",
+			file: "ab-ok.txt",
+			want: caching.LoadStats{
+				Complete:          1000,
+				RequestsPerSecond: 810.37,
+				TransferRateKBps:  94.17,
+				DurationSeconds:   1.234,
+				MeanLatencyMS:     12.34,
+				Percentiles: map[string]float64{
+					"p50": 11, "p66": 12, "p75": 13, "p80": 14, "p90": 17,
+					"p95": 20, "p98": 25, "p99": 30, "p100": 43,
+				},
+			},
+		},
+		{
+			name: "failed and non 2xx",
+			file: "ab-errors.txt",
+			want: caching.LoadStats{
+				Complete:          200,
+				Failed:            7,
+				Non2xx:            13,
+				RequestsPerSecond: 80,
+				TransferRateKBps:  9.16,
+				DurationSeconds:   2.5,
+				MeanLatencyMS:     50,
+				Percentiles: map[string]float64{
+					"p50": 45, "p66": 52, "p75": 58, "p80": 63, "p90": 80,
+					"p95": 99, "p98": 150, "p99": 220, "p100": 310,
+				},
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			output, err := ioutil.ReadFile(filepath.Join("testdata", tc.file))
+			if err != nil {
+				t.Fatalf("could not read %s: %s", tc.file, err)
+			}
+
+			got, err := ParseAB(output)
+			if err != nil {
+				t.Fatalf("ParseAB() got error: %s", err)
+			}
+
+			if got.Complete != tc.want.Complete || got.Failed != tc.want.Failed || got.Non2xx != tc.want.Non2xx {
+				t.Errorf("ParseAB() got complete=%d failed=%d non2xx=%d, want %d, %d, %d",
+					got.Complete, got.Failed, got.Non2xx, tc.want.Complete, tc.want.Failed, tc.want.Non2xx)
+			}
+
+			floats := []struct {
+				name      string
+				got, want float64
+			}{
+				{"requests per second", got.RequestsPerSecond, tc.want.RequestsPerSecond},
+				{"transfer rate", got.TransferRateKBps, tc.want.TransferRateKBps},
+				{"duration", got.DurationSeconds, tc.want.DurationSeconds},
+				{"mean latency", got.MeanLatencyMS, tc.want.MeanLatencyMS},
+			}
+			for _, f := range floats {
+				if f.got != f.want {
+					t.Errorf("ParseAB() %s = %v, want %v", f.name, f.got, f.want)
+				}
+			}
+
+			if len(got.Percentiles) != len(tc.want.Percentiles) {
+				t.Errorf("ParseAB() got %d percentiles, want %d", len(got.Percentiles), len(tc.want.Percentiles))
+			}
+			for p, want := range tc.want.Percentiles {
+				if got.Percentiles[p] != want {
+					t.Errorf("ParseAB() %s = %v, want %v", p, got.Percentiles[p], want)
+				}
+			}
+		})
+	}
+}
+
+func TestParseABErrors(t *testing.T) {
+	cases := []struct {
+		name   string
+		output string
+	}{
+		{"empty", ""},
+		{"no report", "apr_socket_connect(): Connection refused (111)\n"},
+		{"bad count", "Complete requests:      lots\n"},
+		{"bad percentile", "Complete requests:      10\nPercentage of the requests served within a certain time (ms)\n  50%     fast\n"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := ParseAB([]byte(tc.output)); err == nil {
+				t.Errorf("ParseAB() got no error, want one")
+			}
+		})
+	}
+}
+
+func TestParseABTimings(t *testing.T) {
+	f, err := os.Open(filepath.Join("testdata", "ab-timings.tsv"))
+	if err != nil {
+		t.Fatalf("could not open timings: %s", err)
+	}
+	defer f.Close()
+
+	h, err := ParseABTimings(f)
+	if err != nil {
+		t.Fatalf("ParseABTimings() got error: %s", err)
+	}
+
+	if h.Total != 5 {
+		t.Errorf("ParseABTimings() got %d timings, want 5", h.Total)
+	}
+
+	cases := []struct {
+		p    float64
+		want time.Duration
+	}{
+		{0, 5 * time.Millisecond},
+		{50, 10 * time.Millisecond},
+		{100, 100 * time.Millisecond},
+	}
+	for _, tc := range cases {
+		got := h.Percentile(tc.p)
+		// Buckets hold values to within 1/64 of what was recorded.
+		if got < tc.want || got > tc.want+tc.want/64 {
+			t.Errorf("ParseABTimings() p%v = %s, want %s", tc.p, got, tc.want)
+		}
+	}
+}
+
+func TestParseABTimingsEdges(t *testing.T) {
+	cases := []struct {
+		name    string
+		input   string
+		total   int64
+		wantErr bool
+	}{
+		{"empty", "", 0, false},
+		{"header only", "starttime\tseconds\tctime\tdtime\tttime\twait\n", 0, false},
+		{"short line", "Tue Oct 13 10:00:00 2020\t1602583200\t0\n", 0, false},
+		{"bad ttime", "Tue Oct 13 10:00:00 2020\t1602583200\t0\t5\tslow\t5\n", 0, true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			h, err := ParseABTimings(strings.NewReader(tc.input))
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("ParseABTimings() got error %v, want error %t", err, tc.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if h == nil || h.Total != tc.total {
+				t.Errorf("ParseABTimings() = %+v, want a histogram of %d", h, tc.total)
+			}
+		})
+	}
+}
@@ -0,0 +1,88 @@
+package loadgen
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/tpryan/scaling/caching"
+)
+
+// Names of the engines that can be passed to NewEngine.
+const (
+	EngineAB     = "ab"
+	EngineNative = "native"
+)
+
+// Spec describes one run of load from a single generator.
+type Spec struct {
+	// N is the total number of requests to send. It can be left at zero
+	// for a run bounded only by time.
+	N int
+	// C is how many requests are in flight at once.
+	C int
+	// URL is the target, including any query string.
+	URL string
+	// Request is the shape of every request sent to URL.
+	Request Template
+	// QPS switches to an open model: requests are sent at this rate for
+	// Duration no matter how quickly the target answers, and N is ignored.
+	// C, if set, caps the number of requests in flight.
+	QPS float64
+	// Duration bounds the run in time, starting from when it starts.
+	Duration time.Duration
+	// Deadline bounds the run by the wall clock instead of Duration, so that
+	// generators started at different moments stop together.
+	Deadline time.Time
+	// Profile, if set, takes the place of N, QPS and Duration.
+	Profile Profile
+	// Progress, if set, is called with a snapshot of the run every
+	// ProgressInterval, or every second if that is zero. Not every engine
+	// can report progress.
+	Progress         func(Snapshot)
+	ProgressInterval time.Duration
+	// StartAt holds the run back until then, so generators run in lockstep.
+	StartAt time.Time
+	// KeepAlive reuses connections between requests. Like ab, engines open
+	// a new connection for every request unless it is set.
+	KeepAlive bool
+}
+
+// deadline is when a run that started at start has to stop, or zero if it is
+// not bounded in time.
+func (s Spec) deadline(start time.Time) time.Time {
+	if !s.Deadline.IsZero() {
+		return s.Deadline
+	}
+
+	if s.Duration > 0 {
+		return start.Add(s.Duration)
+	}
+
+	return time.Time{}
+}
+
+// Result is what an engine reports once a run is over.
+type Result struct {
+	Stats caching.LoadStats
+	// Output is the human readable report of the run, suitable for logging.
+	Output []byte
+}
+
+// Engine produces load against a target. Cancelling ctx stops the run.
+type Engine interface {
+	Run(ctx context.Context, spec Spec) (Result, error)
+}
+
+// NewEngine returns the engine with the given name. An empty name returns
+// the Apache Bench engine.
+func NewEngine(name string) (Engine, error) {
+	switch name {
+	case "", EngineAB:
+		return AB{}, nil
+	case EngineNative:
+		return Native{}, nil
+	}
+
+	return nil, fmt.Errorf("unknown load engine: %s", name)
+}
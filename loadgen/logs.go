@@ -0,0 +1,36 @@
+package loadgen
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+// LogSink keeps the output of runs, keyed by token and generator, so it can
+// be looked at after the generator is gone. *caching.Cache is one.
+type LogSink interface {
+	SaveLog(token, generator string, data []byte) error
+}
+
+// FileSink writes every log to its own file in Dir.
+type FileSink struct {
+	Dir string
+}
+
+// SaveLog writes a log to disk.
+func (f FileSink) SaveLog(token, generator string, data []byte) error {
+	name := fmt.Sprintf("log_%s_%s.log", safeName(token), safeName(generator))
+	return ioutil.WriteFile(filepath.Join(f.Dir, name), data, 0644)
+}
+
+// safeName keeps callers from steering a file name outside of the directory.
+func safeName(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '.':
+			return r
+		}
+		return '_'
+	}, s)
+}
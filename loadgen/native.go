@@ -0,0 +1,441 @@
+package loadgen
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tpryan/scaling/caching"
+)
+
+// defaultMaxInFlight caps the requests in flight during an open model run
+// when the spec doesn't set C.
+const defaultMaxInFlight = 1000
+
+// idleTick is how often an idle worker or paused schedule checks whether the
+// profile wants more load.
+const idleTick = 10 * time.Millisecond
+
+// requestTimeout is how long a request can take before it fails, the same as
+// ab's default -s.
+const requestTimeout = 30 * time.Second
+
+// lateThreshold is how far behind schedule an open model request can go out
+// before it counts as late.
+const lateThreshold = 10 * time.Millisecond
+
+// reportedPercentiles are the percentiles that ab reports, which the native
+// engine reports too so the two can be compared.
+var reportedPercentiles = []int{50, 66, 75, 80, 90, 95, 98, 99, 100}
+
+// Native is the engine that sends load with Go's http client. It has the same
+// n and c semantics as Apache Bench: n requests in total, with c of them in
+// flight at any one time.
+type Native struct{}
+
+// outcome is the result of a single request.
+type outcome struct {
+	latency time.Duration
+	bytes   int64
+	status  int
+	err     error
+}
+
+// Run sends the requests, stopping early if ctx is cancelled.
+func (e Native) Run(ctx context.Context, spec Spec) (Result, error) {
+	if !waitUntil(ctx, spec.StartAt) {
+		return Result{}, ctx.Err()
+	}
+
+	switch {
+	case len(spec.Profile) > 0 && spec.Profile.RateDriven():
+		return e.runRate(ctx, spec, spec.Profile.RateAt, spec.Profile.Length())
+	case len(spec.Profile) > 0:
+		return e.runConcurrency(ctx, spec)
+	case spec.QPS > 0:
+		deadline := spec.deadline(time.Now())
+		if deadline.IsZero() {
+			return Result{}, fmt.Errorf("a constant rate run needs a duration")
+		}
+		constant := func(time.Duration) float64 { return spec.QPS }
+		return e.runRate(ctx, spec, constant, time.Until(deadline))
+	}
+
+	deadline := spec.deadline(time.Now())
+	if spec.C <= 0 || (spec.N <= 0 && deadline.IsZero()) {
+		return Result{}, fmt.Errorf("c must be positive and the run needs n, a duration or both, got n=%d c=%d", spec.N, spec.C)
+	}
+
+	if spec.N > 0 && spec.C > spec.N {
+		spec.C = spec.N
+	}
+
+	client := newClient(spec.C, spec.KeepAlive)
+
+	run := ctx
+	if !deadline.IsZero() {
+		var cancel context.CancelFunc
+		run, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+	}
+
+	outcomes := &outcomes{}
+	defer watch(spec, outcomes)()
+	var sent int64
+	var wg sync.WaitGroup
+
+	start := time.Now()
+	for i := 0; i < spec.C; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for run.Err() == nil {
+				if spec.N > 0 && atomic.AddInt64(&sent, 1) > int64(spec.N) {
+					return
+				}
+
+				o := hit(run, client, spec)
+				// A request cut off by the deadline is the end of the run
+				// rather than a failure of the target.
+				if o.err != nil && run.Err() != nil && ctx.Err() == nil {
+					return
+				}
+				outcomes.add(o)
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	return finish(ctx, spec, outcomes.summarize(time.Since(start)))
+}
+
+// runRate sends requests on a schedule that follows rate for the length of
+// the run. Latency is measured from when each request was due rather than
+// when it went out, so a target that slows the generator down can't hide it
+// (coordinated omission).
+func (e Native) runRate(ctx context.Context, spec Spec, rate func(time.Duration) float64, length time.Duration) (Result, error) {
+	limit := spec.C
+	if limit <= 0 {
+		limit = defaultMaxInFlight
+	}
+
+	client := newClient(limit, spec.KeepAlive)
+	slots := make(chan struct{}, limit)
+	outcomes := &outcomes{}
+	defer watch(spec, outcomes)()
+	var wg sync.WaitGroup
+
+	stats := caching.LoadStats{}
+	var maxLag time.Duration
+	scheduled := 0
+
+	start := time.Now()
+	schedule, cancel := context.WithDeadline(ctx, start.Add(length))
+	defer cancel()
+
+	// owed adds up the requests the rate has asked for so far, so that a slow
+	// or ramping rate still sends its share rather than waiting a whole
+	// interval at the rate it had when the last request went out.
+	owed := 0.0
+	for t := time.Duration(0); t < length; {
+		r := rate(t)
+		step := idleTick
+		credit := r * step.Seconds()
+		if credit > 1 {
+			step = time.Duration(float64(time.Second) / r)
+			credit = 1
+		}
+
+		due := start.Add(t)
+		t += step
+		owed += credit
+		if owed < 1 {
+			continue
+		}
+		owed--
+		scheduled++
+
+		// Once the schedule is over, keep walking it to count what was
+		// never sent.
+		if stats.Backlog > 0 || !waitUntil(schedule, due) || !acquire(schedule, slots) {
+			stats.Backlog++
+			continue
+		}
+
+		lag := time.Since(due)
+		if lag > lateThreshold {
+			stats.Late++
+		}
+		if lag > maxLag {
+			maxLag = lag
+		}
+
+		wg.Add(1)
+		go func(due time.Time) {
+			defer wg.Done()
+			o := hit(ctx, client, spec)
+			o.latency = time.Since(due)
+			<-slots
+			outcomes.add(o)
+		}(due)
+	}
+
+	wg.Wait()
+
+	summary := outcomes.summarize(time.Since(start))
+	summary.TargetRPS = float64(scheduled) / length.Seconds()
+	summary.Late = stats.Late
+	summary.Backlog = stats.Backlog
+	summary.MaxLagMS = ms(maxLag)
+
+	return finish(ctx, spec, summary)
+}
+
+// runConcurrency keeps as many requests in flight as the profile asks for at
+// each moment, parking the workers that aren't needed.
+func (e Native) runConcurrency(ctx context.Context, spec Spec) (Result, error) {
+	workers := spec.Profile.MaxConcurrency()
+	length := spec.Profile.Length()
+
+	client := newClient(workers, spec.KeepAlive)
+	outcomes := &outcomes{}
+	defer watch(spec, outcomes)()
+	var wg sync.WaitGroup
+
+	start := time.Now()
+	run, cancel := context.WithDeadline(ctx, start.Add(length))
+	defer cancel()
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			for run.Err() == nil {
+				if id >= spec.Profile.ConcurrencyAt(time.Since(start)) {
+					waitUntil(run, time.Now().Add(idleTick))
+					continue
+				}
+				outcomes.add(hit(ctx, client, spec))
+			}
+		}(i)
+	}
+
+	wg.Wait()
+
+	return finish(ctx, spec, outcomes.summarize(time.Since(start)))
+}
+
+// finish wraps up the stats of a run, reporting the context's error if the
+// run was cut short.
+func finish(ctx context.Context, spec Spec, stats caching.LoadStats) (Result, error) {
+	result := Result{Stats: stats, Output: report(spec, stats)}
+
+	if err := ctx.Err(); err != nil {
+		return result, err
+	}
+
+	return result, nil
+}
+
+// outcomes tallies the outcome of every request from many goroutines. Only
+// totals and a histogram are kept, so memory doesn't grow with the length of
+// the run.
+type outcomes struct {
+	mu          sync.Mutex
+	complete    int
+	failed      int
+	non2xx      int
+	transferred int64
+	// answered and latency cover requests that got a response, which are
+	// the only ones whose latency counts.
+	answered  int
+	latency   time.Duration
+	histogram *caching.Histogram
+
+	// window sums up the requests since the last progress snapshot.
+	window     window
+	reportedAt time.Time
+}
+
+// window is what happened between two progress snapshots.
+type window struct {
+	sent     int
+	answered int
+	latency  time.Duration
+	max      time.Duration
+}
+
+func (o *outcomes) add(out outcome) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.complete++
+	o.window.sent++
+	o.transferred += out.bytes
+
+	if out.err != nil {
+		o.failed++
+		return
+	}
+
+	if out.status < 200 || out.status > 299 {
+		o.non2xx++
+	}
+
+	if o.histogram == nil {
+		o.histogram = caching.NewHistogram()
+	}
+	o.histogram.Record(out.latency)
+
+	o.answered++
+	o.latency += out.latency
+
+	o.window.answered++
+	o.window.latency += out.latency
+	if out.latency > o.window.max {
+		o.window.max = out.latency
+	}
+}
+
+// waitUntil sleeps until t, returning false if ctx ends first.
+func waitUntil(ctx context.Context, t time.Time) bool {
+	wait := time.Until(t)
+	if wait <= 0 {
+		return ctx.Err() == nil
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// acquire takes a slot, returning false if ctx ends first.
+func acquire(ctx context.Context, slots chan struct{}) bool {
+	select {
+	case slots <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// newClient returns a client for up to conns requests at once. Without
+// keepAlive every request gets its own connection, as it does with ab, so
+// the two engines put the same connection load on a target.
+func newClient(conns int, keepAlive bool) *http.Client {
+	return &http.Client{
+		Timeout: requestTimeout,
+		Transport: &http.Transport{
+			Proxy:               http.ProxyFromEnvironment,
+			MaxIdleConnsPerHost: conns,
+			DisableKeepAlives:   !keepAlive,
+		},
+	}
+}
+
+// hit sends one request and times it through to the end of the body.
+func hit(ctx context.Context, client *http.Client, spec Spec) outcome {
+	o := outcome{}
+	start := time.Now()
+
+	req, err := spec.Request.request(ctx, spec.URL)
+	if err != nil {
+		o.err = err
+		return o
+	}
+
+	response, err := client.Do(req)
+	if err != nil {
+		o.err = err
+		o.latency = time.Since(start)
+		return o
+	}
+	defer response.Body.Close()
+
+	o.bytes, o.err = io.Copy(ioutil.Discard, response.Body)
+	o.status = response.StatusCode
+	o.latency = time.Since(start)
+
+	return o
+}
+
+// summarize turns the tallies into the same numbers that ab reports, with
+// percentiles read from the histogram.
+func (o *outcomes) summarize(elapsed time.Duration) caching.LoadStats {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	stats := caching.LoadStats{Percentiles: map[string]float64{}}
+	stats.DurationSeconds = elapsed.Seconds()
+	stats.Complete = o.complete
+	stats.Failed = o.failed
+	stats.Non2xx = o.non2xx
+	// A run with no answers still sends an empty histogram, so that it
+	// doesn't stop the others from being merged exactly.
+	stats.Histogram = caching.NewHistogram()
+
+	if elapsed > 0 {
+		stats.RequestsPerSecond = float64(stats.Complete) / elapsed.Seconds()
+		stats.TransferRateKBps = float64(o.transferred) / 1024 / elapsed.Seconds()
+	}
+
+	if o.answered == 0 {
+		return stats
+	}
+
+	stats.MeanLatencyMS = ms(o.latency) / float64(o.answered)
+	stats.Histogram = o.histogram
+
+	for _, p := range reportedPercentiles {
+		stats.Percentiles[fmt.Sprintf("p%d", p)] = ms(o.histogram.Percentile(float64(p)))
+	}
+
+	return stats
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// report writes the stats out in roughly the same shape as ab's report.
+func report(spec Spec, stats caching.LoadStats) []byte {
+	var b bytes.Buffer
+
+	fmt.Fprintf(&b, "Target URL:             %s\n", spec.URL)
+	fmt.Fprintf(&b, "Concurrency Level:      %d\n", spec.C)
+	if len(spec.Profile) > 0 {
+		fmt.Fprintf(&b, "Profile:                %d stages over %s\n", len(spec.Profile), spec.Profile.Length())
+	}
+	fmt.Fprintf(&b, "Time taken for tests:   %.3f seconds\n", stats.DurationSeconds)
+	fmt.Fprintf(&b, "Complete requests:      %d\n", stats.Complete)
+	fmt.Fprintf(&b, "Failed requests:        %d\n", stats.Failed)
+	fmt.Fprintf(&b, "Non-2xx responses:      %d\n", stats.Non2xx)
+	fmt.Fprintf(&b, "Requests per second:    %.2f [#/sec] (mean)\n", stats.RequestsPerSecond)
+	fmt.Fprintf(&b, "Time per request:       %.3f [ms] (mean)\n", stats.MeanLatencyMS)
+	fmt.Fprintf(&b, "Transfer rate:          %.2f [Kbytes/sec] received\n", stats.TransferRateKBps)
+	if stats.TargetRPS > 0 {
+		fmt.Fprintf(&b, "Target rate:            %.2f [#/sec]\n", stats.TargetRPS)
+		fmt.Fprintf(&b, "Late requests:          %d\n", stats.Late)
+		fmt.Fprintf(&b, "Max schedule lag:       %.3f [ms]\n", stats.MaxLagMS)
+		fmt.Fprintf(&b, "Backlog:                %d\n", stats.Backlog)
+	}
+	fmt.Fprintf(&b, "\nPercentage of the requests served within a certain time (ms)\n")
+	for _, p := range reportedPercentiles {
+		fmt.Fprintf(&b, " %3d%%  %6.0f\n", p, stats.Percentiles[fmt.Sprintf("p%d", p)])
+	}
+
+	return b.Bytes()
+}
@@ -0,0 +1,229 @@
+package loadgen
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// target is a test server that keeps track of the load it is sent.
+type target struct {
+	*httptest.Server
+
+	delay  time.Duration
+	status int
+
+	mu       sync.Mutex
+	requests int
+	inFlight int
+	maxIn    int
+	conns    int
+}
+
+func newTarget(t *testing.T, delay time.Duration, status int) *target {
+	tg := &target{delay: delay, status: status}
+
+	tg.Server = httptest.NewUnstartedServer(http.HandlerFunc(tg.serve))
+	tg.Config.ConnState = func(c net.Conn, s http.ConnState) {
+		if s == http.StateNew {
+			tg.mu.Lock()
+			tg.conns++
+			tg.mu.Unlock()
+		}
+	}
+	tg.Start()
+	t.Cleanup(tg.Close)
+
+	return tg
+}
+
+func (tg *target) serve(w http.ResponseWriter, r *http.Request) {
+	tg.mu.Lock()
+	tg.requests++
+	tg.inFlight++
+	if tg.inFlight > tg.maxIn {
+		tg.maxIn = tg.inFlight
+	}
+	tg.mu.Unlock()
+
+	defer func() {
+		tg.mu.Lock()
+		tg.inFlight--
+		tg.mu.Unlock()
+	}()
+
+	select {
+	case <-time.After(tg.delay):
+	case <-r.Context().Done():
+		return
+	}
+
+	w.WriteHeader(tg.status)
+	w.Write([]byte("ok"))
+}
+
+func (tg *target) counts() (requests, maxIn, conns int) {
+	tg.mu.Lock()
+	defer tg.mu.Unlock()
+	return tg.requests, tg.maxIn, tg.conns
+}
+
+func TestNativeClosedLoop(t *testing.T) {
+	cases := []struct {
+		name      string
+		status    int
+		keepAlive bool
+		non2xx    int
+	}{
+		{"new connection per request", http.StatusOK, false, 0},
+		{"keep alive", http.StatusOK, true, 0},
+		{"non 2xx", http.StatusBadGateway, false, 40},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			tg := newTarget(t, 5*time.Millisecond, tc.status)
+
+			spec := Spec{N: 40, C: 4, URL: tg.URL, KeepAlive: tc.keepAlive}
+			result, err := Native{}.Run(context.Background(), spec)
+			if err != nil {
+				t.Fatalf("Run() got error: %s", err)
+			}
+
+			stats := result.Stats
+			if stats.Complete != spec.N || stats.Failed != 0 || stats.Non2xx != tc.non2xx {
+				t.Errorf("Run() got complete=%d failed=%d non2xx=%d, want %d, 0, %d", stats.Complete, stats.Failed, stats.Non2xx, spec.N, tc.non2xx)
+			}
+			if stats.Histogram == nil || stats.Histogram.Total != int64(spec.N) {
+				t.Errorf("Run() histogram = %+v, want %d latencies", stats.Histogram, spec.N)
+			}
+			if stats.Percentiles["p50"] < 5 {
+				t.Errorf("Run() p50 = %.3fms, want at least the target's 5ms", stats.Percentiles["p50"])
+			}
+
+			requests, maxIn, conns := tg.counts()
+			if requests != spec.N {
+				t.Errorf("target got %d requests, want %d", requests, spec.N)
+			}
+			if maxIn > spec.C {
+				t.Errorf("target had %d requests in flight, want at most %d", maxIn, spec.C)
+			}
+
+			switch {
+			case tc.keepAlive && conns > spec.C:
+				t.Errorf("target got %d connections, want at most %d with keep alive", conns, spec.C)
+			case !tc.keepAlive && conns != spec.N:
+				t.Errorf("target got %d connections, want one per request", conns)
+			}
+		})
+	}
+}
+
+func TestNativeClosedLoopCapsC(t *testing.T) {
+	tg := newTarget(t, time.Millisecond, http.StatusOK)
+
+	result, err := Native{}.Run(context.Background(), Spec{N: 3, C: 10, URL: tg.URL})
+	if err != nil {
+		t.Fatalf("Run() got error: %s", err)
+	}
+
+	if result.Stats.Complete != 3 {
+		t.Errorf("Run() sent %d requests, want 3", result.Stats.Complete)
+	}
+	if _, maxIn, _ := tg.counts(); maxIn > 3 {
+		t.Errorf("target had %d requests in flight, want at most 3", maxIn)
+	}
+}
+
+func TestNativeRate(t *testing.T) {
+	cases := []struct {
+		name     string
+		delay    time.Duration
+		c        int
+		late     bool
+		backlog  bool
+		complete bool
+	}{
+		{"keeps up", time.Millisecond, 0, false, false, true},
+		// Two slots of 200ms at one request every 20ms can't keep up, so
+		// requests go out late and the rest of the schedule is never sent.
+		{"falls behind", 200 * time.Millisecond, 2, true, true, false},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			tg := newTarget(t, tc.delay, http.StatusOK)
+
+			spec := Spec{QPS: 50, C: tc.c, Duration: 500 * time.Millisecond, URL: tg.URL}
+			result, err := Native{}.Run(context.Background(), spec)
+			if err != nil {
+				t.Fatalf("Run() got error: %s", err)
+			}
+
+			stats := result.Stats
+			scheduled := int(stats.TargetRPS*spec.Duration.Seconds() + 0.5)
+			if scheduled != 25 {
+				t.Errorf("Run() scheduled %d requests, want 25", scheduled)
+			}
+			if stats.Complete+stats.Backlog != scheduled {
+				t.Errorf("Run() sent %d and skipped %d, want them to add up to %d", stats.Complete, stats.Backlog, scheduled)
+			}
+			if (stats.Late > 0) != tc.late {
+				t.Errorf("Run() late = %d, want late %t", stats.Late, tc.late)
+			}
+			if (stats.Backlog > 0) != tc.backlog {
+				t.Errorf("Run() backlog = %d, want backlog %t", stats.Backlog, tc.backlog)
+			}
+			if tc.complete && stats.Complete != scheduled {
+				t.Errorf("Run() sent %d requests, want all %d", stats.Complete, scheduled)
+			}
+			if tc.late && stats.MaxLagMS < 100 {
+				t.Errorf("Run() max lag = %.3fms, want it to show the wait for a slot", stats.MaxLagMS)
+			}
+
+			if requests, _, _ := tg.counts(); requests != stats.Complete {
+				t.Errorf("target got %d requests, want %d", requests, stats.Complete)
+			}
+		})
+	}
+}
+
+func TestNativeCancel(t *testing.T) {
+	tg := newTarget(t, time.Second, http.StatusOK)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+
+	start := time.Now()
+	result, err := Native{}.Run(ctx, Spec{N: 1000, C: 4, URL: tg.URL})
+	if err != context.Canceled {
+		t.Errorf("Run() got error %v, want %s", err, context.Canceled)
+	}
+	if elapsed := time.Since(start); elapsed > 900*time.Millisecond {
+		t.Errorf("Run() took %s to stop, want it to stop when cancelled", elapsed)
+	}
+	if result.Stats.Complete > 4 {
+		t.Errorf("Run() sent %d requests, want no more than the first %d", result.Stats.Complete, 4)
+	}
+}
+
+func TestNewClient(t *testing.T) {
+	client := newClient(4, false)
+
+	if client.Timeout != requestTimeout {
+		t.Errorf("newClient() timeout = %s, want %s", client.Timeout, requestTimeout)
+	}
+
+	transport := client.Transport.(*http.Transport)
+	if !transport.DisableKeepAlives {
+		t.Errorf("newClient() kept connections alive, want a new one per request like ab")
+	}
+
+	if newClient(4, true).Transport.(*http.Transport).DisableKeepAlives {
+		t.Errorf("newClient() with keep alive disabled keep alives")
+	}
+}
@@ -0,0 +1,131 @@
+package loadgen
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/tpryan/scaling/caching"
+)
+
+// Rules that a target can be rejected by.
+const (
+	RuleParse      = "parse"
+	RuleScheme     = "scheme"
+	RuleDeny       = "deny"
+	RulePath       = "path"
+	RuleNotAllowed = "not-allowed"
+)
+
+// TargetPolicy decides which URLs a generator will send load to, so that it
+// can't be turned on anything but the services it is meant to test. Deny
+// rules win over everything. Past that, a target has to be a registered
+// receiver or match an Allow entry.
+type TargetPolicy struct {
+	// Schemes that targets can use. Empty allows http and https.
+	Schemes []string
+	// PathPrefixes, if set, are the only paths targets can start with.
+	// Paths are cleaned first and matched on whole segments, so "/api"
+	// allows "/api" and "/api/users" but not "/apifoo" or "/api/../admin".
+	PathPrefixes []string
+	// Allow and Deny hold host patterns: a host like "example.com", a host
+	// and port like "example.com:8080", a wildcard like "*.example.com", or
+	// a CIDR block like "10.0.0.0/8" that matches IP targets. CIDR blocks
+	// are not checked against what a hostname resolves to, so denying a
+	// block does not stop a name that points into it.
+	Allow []string
+	Deny  []string
+}
+
+// Check returns a rejection saying why the target is refused, or nil if it
+// is fine. receivers are the registered receivers, which are always allowed
+// unless denied.
+func (p TargetPolicy) Check(target string, receivers []*url.URL) *caching.Rejection {
+	u, err := url.Parse(target)
+	if err != nil || len(u.Hostname()) == 0 {
+		return &caching.Rejection{Rule: RuleParse, Reason: fmt.Sprintf("could not parse target %q", target)}
+	}
+
+	schemes := p.Schemes
+	if len(schemes) == 0 {
+		schemes = []string{"http", "https"}
+	}
+	if !contains(schemes, u.Scheme) {
+		return &caching.Rejection{Rule: RuleScheme, Reason: fmt.Sprintf("scheme %q is not one of %s", u.Scheme, strings.Join(schemes, ", "))}
+	}
+
+	for _, d := range p.Deny {
+		if matchHost(d, u) {
+			return &caching.Rejection{Rule: RuleDeny, Reason: fmt.Sprintf("target matches deny rule %q", d)}
+		}
+	}
+
+	if len(p.PathPrefixes) > 0 && !hasPrefix(u.Path, p.PathPrefixes) {
+		return &caching.Rejection{Rule: RulePath, Reason: fmt.Sprintf("path %q does not start with one of %s", u.Path, strings.Join(p.PathPrefixes, ", "))}
+	}
+
+	for _, r := range receivers {
+		if r.Hostname() == u.Hostname() && r.Port() == u.Port() {
+			return nil
+		}
+	}
+
+	for _, a := range p.Allow {
+		if matchHost(a, u) {
+			return nil
+		}
+	}
+
+	return &caching.Rejection{Rule: RuleNotAllowed, Reason: fmt.Sprintf("%s is not a registered receiver or on the allowlist", u.Host)}
+}
+
+// matchHost reports whether a host pattern matches the host of u.
+func matchHost(pattern string, u *url.URL) bool {
+	if _, block, err := net.ParseCIDR(pattern); err == nil {
+		ip := net.ParseIP(u.Hostname())
+		return ip != nil && block.Contains(ip)
+	}
+
+	host, port := pattern, ""
+	if h, p, err := net.SplitHostPort(pattern); err == nil {
+		host, port = h, p
+	}
+
+	if len(port) > 0 && port != u.Port() {
+		return false
+	}
+
+	name := strings.ToLower(u.Hostname())
+	host = strings.ToLower(host)
+
+	if strings.HasPrefix(host, "*.") {
+		return strings.HasSuffix(name, host[1:])
+	}
+
+	return name == host
+}
+
+// hasPrefix reports whether a cleaned path starts with one of the prefixes,
+// matching whole segments.
+func hasPrefix(target string, prefixes []string) bool {
+	p := path.Clean("/" + target)
+
+	for _, prefix := range prefixes {
+		prefix = strings.TrimSuffix(prefix, "/")
+		if p == prefix || strings.HasPrefix(p, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
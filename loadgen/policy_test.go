@@ -0,0 +1,64 @@
+package loadgen
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestTargetPolicyCheck(t *testing.T) {
+	receiver, _ := url.Parse("http://receiver.example.com:8080/record")
+
+	cases := []struct {
+		name   string
+		policy TargetPolicy
+		target string
+		rule   string
+	}{
+		{"receiver", TargetPolicy{}, "http://receiver.example.com:8080/record", ""},
+		{"receiver on another port", TargetPolicy{}, "http://receiver.example.com:9090/record", RuleNotAllowed},
+		{"unknown host", TargetPolicy{}, "http://example.org/", RuleNotAllowed},
+		{"unparseable", TargetPolicy{}, "://nope", RuleParse},
+
+		{"default schemes", TargetPolicy{}, "ftp://receiver.example.com:8080/", RuleScheme},
+		{"https allowed", TargetPolicy{Allow: []string{"example.org"}}, "https://example.org/", ""},
+		{"scheme not listed", TargetPolicy{Schemes: []string{"https"}, Allow: []string{"example.org"}}, "http://example.org/", RuleScheme},
+
+		{"deny wins over receiver", TargetPolicy{Deny: []string{"receiver.example.com"}}, "http://receiver.example.com:8080/record", RuleDeny},
+		{"deny wins over allow", TargetPolicy{Allow: []string{"*.example.org"}, Deny: []string{"admin.example.org"}}, "http://admin.example.org/", RuleDeny},
+		{"deny host and port", TargetPolicy{Allow: []string{"example.org"}, Deny: []string{"example.org:8443"}}, "http://example.org:8443/", RuleDeny},
+		{"deny other port", TargetPolicy{Allow: []string{"example.org"}, Deny: []string{"example.org:8443"}}, "http://example.org:8080/", ""},
+
+		{"wildcard subdomain", TargetPolicy{Allow: []string{"*.example.org"}}, "http://api.example.org/", ""},
+		{"wildcard nested", TargetPolicy{Allow: []string{"*.example.org"}}, "http://a.b.example.org/", ""},
+		{"wildcard apex", TargetPolicy{Allow: []string{"*.example.org"}}, "http://example.org/", RuleNotAllowed},
+		{"wildcard lookalike", TargetPolicy{Allow: []string{"*.example.org"}}, "http://badexample.org/", RuleNotAllowed},
+		{"host case", TargetPolicy{Allow: []string{"Example.org"}}, "http://EXAMPLE.org/", ""},
+
+		{"cidr allow", TargetPolicy{Allow: []string{"10.0.0.0/8"}}, "http://10.1.2.3/", ""},
+		{"cidr outside", TargetPolicy{Allow: []string{"10.0.0.0/8"}}, "http://11.1.2.3/", RuleNotAllowed},
+		{"cidr deny", TargetPolicy{Allow: []string{"10.0.0.0/8"}, Deny: []string{"10.0.0.0/24"}}, "http://10.0.0.5/", RuleDeny},
+		{"cidr deny skips hostnames", TargetPolicy{Allow: []string{"example.org"}, Deny: []string{"0.0.0.0/0"}}, "http://example.org/", ""},
+
+		{"path prefix", TargetPolicy{PathPrefixes: []string{"/api"}, Allow: []string{"example.org"}}, "http://example.org/api/users", ""},
+		{"path exact", TargetPolicy{PathPrefixes: []string{"/api"}, Allow: []string{"example.org"}}, "http://example.org/api", ""},
+		{"path trailing slash prefix", TargetPolicy{PathPrefixes: []string{"/api/"}, Allow: []string{"example.org"}}, "http://example.org/api", ""},
+		{"path partial segment", TargetPolicy{PathPrefixes: []string{"/api"}, Allow: []string{"example.org"}}, "http://example.org/apifoo", RulePath},
+		{"path traversal", TargetPolicy{PathPrefixes: []string{"/api"}, Allow: []string{"example.org"}}, "http://example.org/api/../admin", RulePath},
+		{"path encoded traversal", TargetPolicy{PathPrefixes: []string{"/api"}, Allow: []string{"example.org"}}, "http://example.org/api/%2e%2e/admin", RulePath},
+		{"path empty", TargetPolicy{PathPrefixes: []string{"/api"}, Allow: []string{"example.org"}}, "http://example.org", RulePath},
+		{"path root prefix", TargetPolicy{PathPrefixes: []string{"/"}, Allow: []string{"example.org"}}, "http://example.org", ""},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			rejection := c.policy.Check(c.target, []*url.URL{receiver})
+
+			switch {
+			case rejection == nil && len(c.rule) > 0:
+				t.Errorf("Check(%q) allowed it, want rejection by %s", c.target, c.rule)
+			case rejection != nil && rejection.Rule != c.rule:
+				t.Errorf("Check(%q) rejected it by %s (%s), want %q", c.target, rejection.Rule, rejection.Reason, c.rule)
+			}
+		})
+	}
+}
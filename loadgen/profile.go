@@ -0,0 +1,107 @@
+package loadgen
+
+import (
+	"time"
+
+	"github.com/tpryan/scaling/caching"
+)
+
+// Stage is one step of a load profile, with its target reached either at the
+// start of the stage or, if Linear, by ramping across it.
+type Stage struct {
+	Duration time.Duration
+	QPS      float64
+	C        int
+	Linear   bool
+}
+
+// Profile is a series of stages run back to back.
+type Profile []Stage
+
+// NewProfile checks and converts the stages of a load request.
+func NewProfile(p caching.Profile) (Profile, error) {
+	profile := Profile{}
+
+	if err := p.Validate(); err != nil {
+		return profile, err
+	}
+
+	for _, s := range p {
+		d, err := time.ParseDuration(s.Duration)
+		if err != nil {
+			return profile, err
+		}
+
+		profile = append(profile, Stage{
+			Duration: d,
+			QPS:      s.QPS,
+			C:        s.C,
+			Linear:   s.Transition == caching.TransitionLinear,
+		})
+	}
+
+	return profile, nil
+}
+
+// Length is how long the whole profile takes to run.
+func (p Profile) Length() time.Duration {
+	var total time.Duration
+	for _, s := range p {
+		total += s.Duration
+	}
+	return total
+}
+
+// RateDriven reports whether the profile targets a rate rather than a
+// concurrency.
+func (p Profile) RateDriven() bool {
+	for _, s := range p {
+		if s.QPS > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// RateAt returns the target rate at a point in the profile.
+func (p Profile) RateAt(t time.Duration) float64 {
+	return p.valueAt(t, func(s Stage) float64 { return s.QPS })
+}
+
+// ConcurrencyAt returns the target concurrency at a point in the profile.
+func (p Profile) ConcurrencyAt(t time.Duration) int {
+	return int(p.valueAt(t, func(s Stage) float64 { return float64(s.C) }) + 0.5)
+}
+
+// MaxConcurrency is the highest concurrency any stage targets.
+func (p Profile) MaxConcurrency() int {
+	max := 0
+	for _, s := range p {
+		if s.C > max {
+			max = s.C
+		}
+	}
+	return max
+}
+
+// valueAt interpolates a target at a point in the profile, ramping from the
+// previous stage's target during linear stages. Before the first stage the
+// previous target is zero.
+func (p Profile) valueAt(t time.Duration, target func(Stage) float64) float64 {
+	previous := 0.0
+
+	for _, s := range p {
+		if t < s.Duration {
+			if !s.Linear {
+				return target(s)
+			}
+			progress := float64(t) / float64(s.Duration)
+			return previous + (target(s)-previous)*progress
+		}
+
+		t -= s.Duration
+		previous = target(s)
+	}
+
+	return 0
+}
@@ -0,0 +1,88 @@
+package loadgen
+
+import "time"
+
+// defaultProgressInterval is how often a run reports its progress when the
+// spec doesn't say.
+const defaultProgressInterval = time.Second
+
+// Snapshot is how a run is going partway through. Rate and the latencies
+// cover the time since the previous snapshot, while Sent and Errors are
+// totals for the run so far.
+type Snapshot struct {
+	Sent        int
+	Errors      int
+	Rate        float64
+	MeanLatency time.Duration
+	MaxLatency  time.Duration
+}
+
+// snapshot sums up the requests that finished since the last snapshot.
+func (o *outcomes) snapshot() Snapshot {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	now := time.Now()
+	w := o.window
+
+	s := Snapshot{
+		Sent:       o.complete,
+		Errors:     o.failed + o.non2xx,
+		MaxLatency: w.max,
+	}
+
+	// Like the final stats, latency only counts requests that were answered.
+	if w.answered > 0 {
+		s.MeanLatency = w.latency / time.Duration(w.answered)
+	}
+
+	if elapsed := now.Sub(o.reportedAt); elapsed > 0 {
+		s.Rate = float64(w.sent) / elapsed.Seconds()
+	}
+
+	o.window = window{}
+	o.reportedAt = now
+
+	return s
+}
+
+// watch passes a snapshot of the run to spec.Progress on an interval. The
+// returned function stops it, and should be called once the run is over.
+func watch(spec Spec, o *outcomes) func() {
+	if spec.Progress == nil {
+		return func() {}
+	}
+
+	interval := spec.ProgressInterval
+	if interval <= 0 {
+		interval = defaultProgressInterval
+	}
+
+	o.mu.Lock()
+	o.reportedAt = time.Now()
+	o.mu.Unlock()
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+
+	go func() {
+		defer close(stopped)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				spec.Progress(o.snapshot())
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
@@ -0,0 +1,61 @@
+package loadgen
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+
+	"github.com/tpryan/scaling/caching"
+)
+
+// Template is the request sent over and over during a run. The zero value is
+// a GET with no body.
+type Template struct {
+	Method string
+	Header http.Header
+	Body   []byte
+}
+
+// NewTemplate checks a request template and builds its body up front, so
+// that nothing is allocated per request but the request itself.
+func NewTemplate(t caching.RequestTemplate) (Template, error) {
+	tmpl := Template{Method: t.HTTPMethod(), Header: http.Header{}}
+
+	if err := t.Validate(); err != nil {
+		return tmpl, err
+	}
+
+	for k, v := range t.Headers {
+		tmpl.Header.Set(k, v)
+	}
+
+	if len(t.ContentType) > 0 {
+		tmpl.Header.Set("Content-Type", t.ContentType)
+	}
+
+	tmpl.Body = []byte(t.Body)
+	if t.BodySize > 0 {
+		tmpl.Body = bytes.Repeat([]byte("x"), t.BodySize)
+	}
+
+	return tmpl, nil
+}
+
+// request makes one request to u from the template.
+func (t Template) request(ctx context.Context, u string) (*http.Request, error) {
+	method := t.Method
+	if len(method) == 0 {
+		method = http.MethodGet
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u, bytes.NewReader(t.Body))
+	if err != nil {
+		return nil, err
+	}
+
+	for k, v := range t.Header {
+		req.Header[k] = v
+	}
+
+	return req, nil
+}
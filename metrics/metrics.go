@@ -0,0 +1,379 @@
+// Package metrics keeps counters, gauges and histograms and serves them at
+// /metrics in the Prometheus text format, without pulling in the Prometheus
+// client libraries.
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets are histogram upper bounds in seconds that suit request
+// latencies.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Registry holds a set of metrics to serve together.
+type Registry struct {
+	mu      sync.Mutex
+	metrics []family
+}
+
+// family is a metric and all of its label combinations.
+type family interface {
+	write(b *bytes.Buffer)
+}
+
+// NewRegistry returns an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) add(f family) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.metrics = append(r.metrics, f)
+}
+
+// Handler serves every metric in the registry.
+func (r *Registry) Handler() http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		var b bytes.Buffer
+
+		r.mu.Lock()
+		for _, f := range r.metrics {
+			f.write(&b)
+		}
+		r.mu.Unlock()
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		w.Write(b.Bytes())
+	}
+}
+
+// vec keeps one value per combination of label values.
+type vec struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]interface{}
+	keys   map[string][]string
+}
+
+func newVec(name, help, kind string, labels []string) *vec {
+	return &vec{
+		name:   name,
+		help:   help,
+		kind:   kind,
+		labels: labels,
+		values: map[string]interface{}{},
+		keys:   map[string][]string{},
+	}
+}
+
+// get returns the value for the label values, making it if needed.
+func (v *vec) get(values []string, make func() interface{}) interface{} {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("metric %s has %d labels, got %d values", v.name, len(v.labels), len(values)))
+	}
+
+	key := strings.Join(values, "\xff")
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	m, ok := v.values[key]
+	if !ok {
+		m = make()
+		v.values[key] = m
+		v.keys[key] = append([]string{}, values...)
+	}
+
+	return m
+}
+
+// each calls fn with the label set and value of every combination, in a
+// stable order.
+func (v *vec) each(fn func(labels string, value interface{})) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	keys := []string{}
+	for k := range v.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		fn(labelSet(v.labels, v.keys[k], "", ""), v.values[k])
+	}
+}
+
+func (v *vec) header(b *bytes.Buffer) {
+	fmt.Fprintf(b, "# HELP %s %s\n", v.name, escape(v.help, false))
+	fmt.Fprintf(b, "# TYPE %s %s\n", v.name, v.kind)
+}
+
+// labelSet formats labels like {a="1",b="2"}, with an extra label on the
+// end if extra is set.
+func labelSet(names, values []string, extra, extraValue string) string {
+	parts := []string{}
+	for i, n := range names {
+		parts = append(parts, fmt.Sprintf("%s=\"%s\"", n, escape(values[i], true)))
+	}
+	if len(extra) > 0 {
+		parts = append(parts, fmt.Sprintf("%s=\"%s\"", extra, escape(extraValue, true)))
+	}
+
+	if len(parts) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func escape(s string, quotes bool) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	s = strings.Replace(s, "\n", `\n`, -1)
+	if quotes {
+		s = strings.Replace(s, `"`, `\"`, -1)
+	}
+	return s
+}
+
+func format(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// value is a float that can be changed from many goroutines.
+type value struct {
+	mu sync.Mutex
+	v  float64
+}
+
+func (v *value) add(d float64) {
+	v.mu.Lock()
+	v.v += d
+	v.mu.Unlock()
+}
+
+func (v *value) set(f float64) {
+	v.mu.Lock()
+	v.v = f
+	v.mu.Unlock()
+}
+
+func (v *value) get() float64 {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.v
+}
+
+// CounterVec is a counter split by labels.
+type CounterVec struct {
+	*vec
+}
+
+// Counter is a value that only goes up.
+type Counter struct {
+	v *value
+}
+
+// NewCounter adds a counter to the registry.
+func (r *Registry) NewCounter(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{newVec(name, help, "counter", labels)}
+	r.add(c)
+
+	// Metrics without labels show up as zero before they are first used.
+	if len(labels) == 0 {
+		c.With()
+	}
+
+	return c
+}
+
+// With returns the counter for the label values, in the order the labels
+// were given.
+func (c *CounterVec) With(values ...string) Counter {
+	return Counter{c.get(values, func() interface{} { return &value{} }).(*value)}
+}
+
+// Inc adds one to the counter.
+func (c Counter) Inc() {
+	c.v.add(1)
+}
+
+// Add adds to the counter. Negative values are ignored.
+func (c Counter) Add(f float64) {
+	if f < 0 {
+		return
+	}
+	c.v.add(f)
+}
+
+func (c *CounterVec) write(b *bytes.Buffer) {
+	c.header(b)
+	c.each(func(labels string, v interface{}) {
+		fmt.Fprintf(b, "%s%s %s\n", c.name, labels, format(v.(*value).get()))
+	})
+}
+
+// GaugeVec is a gauge split by labels.
+type GaugeVec struct {
+	*vec
+}
+
+// Gauge is a value that can go up and down.
+type Gauge struct {
+	v *value
+}
+
+// NewGauge adds a gauge to the registry.
+func (r *Registry) NewGauge(name, help string, labels ...string) *GaugeVec {
+	g := &GaugeVec{newVec(name, help, "gauge", labels)}
+	r.add(g)
+
+	if len(labels) == 0 {
+		g.With()
+	}
+
+	return g
+}
+
+// With returns the gauge for the label values, in the order the labels were
+// given.
+func (g *GaugeVec) With(values ...string) Gauge {
+	return Gauge{g.get(values, func() interface{} { return &value{} }).(*value)}
+}
+
+// Set changes the gauge to f.
+func (g Gauge) Set(f float64) {
+	g.v.set(f)
+}
+
+// Add adds to the gauge, which can be negative.
+func (g Gauge) Add(f float64) {
+	g.v.add(f)
+}
+
+// Inc adds one to the gauge.
+func (g Gauge) Inc() {
+	g.v.add(1)
+}
+
+// Dec takes one from the gauge.
+func (g Gauge) Dec() {
+	g.v.add(-1)
+}
+
+func (g *GaugeVec) write(b *bytes.Buffer) {
+	g.header(b)
+	g.each(func(labels string, v interface{}) {
+		fmt.Fprintf(b, "%s%s %s\n", g.name, labels, format(v.(*value).get()))
+	})
+}
+
+// HistogramVec is a histogram split by labels.
+type HistogramVec struct {
+	*vec
+	buckets []float64
+}
+
+// Histogram counts observations into buckets.
+type Histogram struct {
+	h *histogram
+}
+
+type histogram struct {
+	mu      sync.Mutex
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+// NewHistogram adds a histogram to the registry, with the given bucket upper
+// bounds in increasing order.
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	h := &HistogramVec{newVec(name, help, "histogram", labels), buckets}
+	r.add(h)
+
+	if len(labels) == 0 {
+		h.With()
+	}
+
+	return h
+}
+
+// With returns the histogram for the label values, in the order the labels
+// were given.
+func (h *HistogramVec) With(values ...string) Histogram {
+	return Histogram{h.get(values, func() interface{} {
+		return &histogram{buckets: h.buckets, counts: make([]uint64, len(h.buckets))}
+	}).(*histogram)}
+}
+
+// Observe counts one value.
+func (h Histogram) Observe(f float64) {
+	h.ObserveN(f, 1)
+}
+
+// ObserveN counts the same value n times, for when observations arrive
+// already bucketed.
+func (h Histogram) ObserveN(f float64, n uint64) {
+	h.h.mu.Lock()
+	defer h.h.mu.Unlock()
+
+	for i, upper := range h.h.buckets {
+		if f <= upper {
+			h.h.counts[i] += n
+			break
+		}
+	}
+	h.h.sum += f * float64(n)
+	h.h.count += n
+}
+
+func (h *HistogramVec) write(b *bytes.Buffer) {
+	h.header(b)
+
+	h.vec.mu.Lock()
+	keys := []string{}
+	for k := range h.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	h.vec.mu.Unlock()
+
+	for _, k := range keys {
+		h.vec.mu.Lock()
+		values := h.keys[k]
+		hist := h.values[k].(*histogram)
+		h.vec.mu.Unlock()
+
+		hist.mu.Lock()
+		cumulative := uint64(0)
+		for i, upper := range hist.buckets {
+			cumulative += hist.counts[i]
+			fmt.Fprintf(b, "%s_bucket%s %d\n", h.name, labelSet(h.labels, values, "le", format(upper)), cumulative)
+		}
+		fmt.Fprintf(b, "%s_bucket%s %d\n", h.name, labelSet(h.labels, values, "le", "+Inf"), hist.count)
+		fmt.Fprintf(b, "%s_sum%s %s\n", h.name, labelSet(h.labels, values, "", ""), format(hist.sum))
+		fmt.Fprintf(b, "%s_count%s %d\n", h.name, labelSet(h.labels, values, "", ""), hist.count)
+		hist.mu.Unlock()
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/teris-io/shortid"
@@ -46,13 +47,24 @@ func init() {
 		log.Fatal(fmt.Errorf("cannot connect to %s:%s: %s", redisHost, redisHost, err))
 	}
 
-	if err := cache.RegisterReceiver(environment, endpoint); err != nil {
+	// A function only has the one url, so health checks come to a path
+	// under it unless HEALTH_ENDPOINT points at a separate function.
+	health := os.Getenv("HEALTH_ENDPOINT")
+	if len(health) == 0 {
+		health = strings.TrimSuffix(endpoint, "/") + "/healthz"
+	}
+
+	if err := cache.RegisterReceiverWithHealth(environment, endpoint, health); err != nil {
 		log.Fatal(fmt.Errorf("cannot register a new instance: %s", err))
 	}
 }
 
 // Record takes a hit from load and records in Redis
 func Record(w http.ResponseWriter, r *http.Request) {
+	if strings.HasSuffix(r.URL.Path, "/healthz") {
+		Health(w, r)
+		return
+	}
 
 	if err := cache.Record(instance); err != nil {
 		apitools.Error(w, err)
@@ -66,6 +78,12 @@ func Record(w http.ResponseWriter, r *http.Request) {
 
 }
 
+// Health answers the visualizer's health checks without recording a hit.
+func Health(w http.ResponseWriter, r *http.Request) {
+	apitools.Success(w, "ok")
+	return
+}
+
 func getID() (string, error) {
 
 	sid, err := shortid.New(1, shortid.DefaultABC, uint64(time.Now().Unix()))
@@ -1,10 +1,13 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -20,6 +23,9 @@ var (
 	instance    = caching.Instance{}
 	environment = ""
 	endpoint    = ""
+	// shutdownTimeout is how long in-flight requests get to finish once
+	// the receiver is told to stop.
+	shutdownTimeout = 10 * time.Second
 )
 
 func main() {
@@ -48,6 +54,14 @@ func main() {
 		log.Fatal(fmt.Errorf("cannot connect to %s:%s: %s", redisHost, redisHost, err))
 	}
 
+	if resolution := os.Getenv("RESOLUTION"); len(resolution) > 0 {
+		d, err := time.ParseDuration(resolution)
+		if err != nil {
+			log.Fatal(fmt.Errorf("invalid value for env variable `RESOLUTION`: %s", resolution))
+		}
+		cache.SetResolution(d)
+	}
+
 	if err := cache.RegisterReceiver(environment, endpoint); err != nil {
 		log.Fatal(fmt.Errorf("cannot register a new instance: %s", err))
 	}
@@ -56,13 +70,39 @@ func main() {
 	r.HandleFunc("/healthz", handleHealth)
 	r.HandleFunc("/register", handleRegister)
 	r.HandleFunc("/record", handleRecord)
+	r.HandleFunc("/metrics", registry.Handler())
 	r.HandleFunc("/", handleHealth)
 
-	http.Handle("/", r)
-	if err := http.ListenAndServe(port, nil); err != nil {
+	http.Handle("/", trackInFlight(r))
+	srv := &http.Server{Addr: port}
+
+	// Platforms send SIGTERM before they take an instance away, so record
+	// when that happens as the moment the instance was scaled down.
+	stopped := make(chan struct{})
+	go func() {
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGTERM, os.Interrupt)
+		<-sigs
+
+		fmt.Printf("shutting down\n")
+		if err := cache.RecordTermination(instance); err != nil {
+			fmt.Printf("could not record termination: %s\n", err)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			fmt.Printf("could not shut down webserver cleanly: %s\n", err)
+		}
+
+		close(stopped)
+	}()
+
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
 		log.Fatal(err)
 	}
 
+	<-stopped
 }
 
 func handleHealth(w http.ResponseWriter, r *http.Request) {
@@ -81,12 +121,18 @@ func handleRegister(w http.ResponseWriter, r *http.Request) {
 }
 
 func handleRecord(w http.ResponseWriter, r *http.Request) {
-	if err := cache.Record(instance); err != nil {
+	start := time.Now()
+	err := cache.Record(instance)
+	cacheWriteLatency.With().Observe(time.Since(start).Seconds())
+
+	if err != nil {
+		cacheWriteErrors.With().Inc()
 		apitools.Error(w, err)
 		return
 	}
 
 	instance.Incr()
+	hits.With().Inc()
 
 	apitools.JSON(w, instance)
 	return
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/tpryan/scaling/metrics"
+)
+
+var (
+	registry = metrics.NewRegistry()
+
+	hits = registry.NewCounter("receiver_hits_total",
+		"Hits recorded against this instance.")
+	inFlight = registry.NewGauge("receiver_in_flight_requests",
+		"Requests being handled right now.")
+	cacheWriteLatency = registry.NewHistogram("receiver_cache_write_seconds",
+		"Time taken to record a hit in the cache.", metrics.DefaultBuckets)
+	cacheWriteErrors = registry.NewCounter("receiver_cache_write_errors_total",
+		"Hits that could not be recorded in the cache.")
+)
+
+// trackInFlight counts requests while they are being handled.
+func trackInFlight(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		inFlight.With().Inc()
+		defer inFlight.With().Dec()
+
+		next.ServeHTTP(w, r)
+	})
+}
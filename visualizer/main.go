@@ -1,12 +1,17 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/tpryan/scaling/apitools"
 	"github.com/tpryan/scaling/caching"
@@ -18,6 +23,13 @@ var (
 	port        = ""
 	instance    = caching.Instance{}
 	environment = ""
+	// distributeTimeout bounds how long a run of n requests can take unless
+	// the caller asks for something else. Runs bounded by time get their
+	// length and a grace period instead.
+	distributeTimeout = 10 * time.Minute
+	// shutdownTimeout is how long in-flight requests get to finish once
+	// the visualizer is told to stop.
+	shutdownTimeout = 10 * time.Second
 )
 
 func main() {
@@ -36,19 +48,105 @@ func main() {
 		log.Fatal(err)
 	}
 
+	cache.SetResolution(envDuration("RESOLUTION", caching.DefaultResolution))
+	cache.SetGeneratorTTL(envDuration("GENERATOR_TTL", caching.DefaultGeneratorTTL), os.Getenv("REAP_GENERATORS") == "true")
+	cache.SetLifecycle(caching.Lifecycle{
+		Warmup:     envDuration("WARMUP_THRESHOLD", caching.DefaultLifecycle.Warmup),
+		Idle:       envDuration("IDLE_THRESHOLD", caching.DefaultLifecycle.Idle),
+		Terminated: envDuration("TERMINATED_THRESHOLD", caching.DefaultLifecycle.Terminated),
+	})
+
+	distributeTimeout = envDuration("DISTRIBUTE_TIMEOUT", distributeTimeout)
+
+	// Generators refuse unsigned commands unless they were started with
+	// ALLOW_UNSIGNED_CONTROL.
+	secret := os.Getenv("CONTROL_SECRET")
+	if len(secret) == 0 {
+		log.Printf("WARNING: CONTROL_SECRET is not set, commands to generators will be unsigned and only generators with ALLOW_UNSIGNED_CONTROL=true will take them")
+	}
+	cache.SetControlSecret(secret)
+
+	go startProbing(envDuration("PROBE_INTERVAL", 10*time.Second))
+
 	http.HandleFunc("/healthz", handleHealth)
 	http.HandleFunc("/api/index", handleIndex)
+	http.HandleFunc("/api/series", handleSeries)
 	http.HandleFunc("/api/nodes", handleNodeList)
 	http.HandleFunc("/api/receivers", handleReceiverList)
+	http.HandleFunc("/api/runs", handleRunList)
+	http.HandleFunc("/api/runs/start", handleRunStart)
 	http.HandleFunc("/api/clear", handleClear)
 	http.HandleFunc("/api/distribute", handleDistribute)
+	http.HandleFunc("/api/jobs", handleJobList)
+	http.HandleFunc("/api/job", handleJob)
+	http.HandleFunc("/api/progress", handleProgress)
+	http.HandleFunc("/api/abort", handleAbort)
+	http.HandleFunc("/api/percentiles", handlePercentiles)
+	http.HandleFunc("/api/logs", handleLogList)
+	http.HandleFunc("/api/log", handleLog)
+	http.HandleFunc("/metrics", registry.Handler())
 
 	http.Handle("/", http.FileServer(http.Dir("./static")))
 
-	if err := http.ListenAndServe(port, nil); err != nil {
+	srv := &http.Server{Addr: port}
+
+	// Jobs run in the background of this process, so they are aborted
+	// rather than left marked as running forever when it is stopped.
+	stopped := make(chan struct{})
+	go func() {
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGTERM, os.Interrupt)
+		<-sigs
+
+		fmt.Printf("shutting down\n")
+		cache.AbortRunning(&http.Client{Timeout: 5 * time.Second})
+
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			fmt.Printf("could not shut down webserver cleanly: %s\n", err)
+		}
+
+		close(stopped)
+	}()
+
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
 		log.Fatal(err)
 	}
 
+	<-stopped
+}
+
+// progressInterval is how often /api/progress sends an update.
+const progressInterval = time.Second
+
+// envDuration reads a duration like "10s" from the environment, falling back
+// to the given value if it is not set.
+func envDuration(name string, fallback time.Duration) time.Duration {
+	v := os.Getenv(name)
+	if len(v) == 0 {
+		return fallback
+	}
+
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		log.Fatal(fmt.Errorf("invalid value for env variable `%s`: %s", name, v))
+	}
+
+	return d
+}
+
+// startProbing checks on the health of every receiver on an interval so that
+// /api/receivers can report which targets are up.
+func startProbing(interval time.Duration) {
+	fmt.Printf("starting receiver probing\n")
+	client := &http.Client{Timeout: 5 * time.Second}
+	for {
+		if err := cache.ProbeReceivers(client); err != nil {
+			fmt.Printf("could not probe receivers: %s\n", err)
+		}
+		time.Sleep(interval)
+	}
 }
 
 func handleHealth(w http.ResponseWriter, r *http.Request) {
@@ -58,8 +156,9 @@ func handleHealth(w http.ResponseWriter, r *http.Request) {
 
 func handleIndex(w http.ResponseWriter, r *http.Request) {
 
-	index, err := cache.InstanceReport()
+	index, err := cache.InstanceReport(r.URL.Query().Get("run"))
 	if err != nil {
+		cacheErrors.With("index").Inc()
 		fmt.Printf("%s\n", err)
 	}
 
@@ -68,10 +167,52 @@ func handleIndex(w http.ResponseWriter, r *http.Request) {
 	return
 }
 
+func handleSeries(w http.ResponseWriter, r *http.Request) {
+	to := time.Now()
+	from := to.Add(-5 * time.Minute)
+
+	if f := r.URL.Query().Get("from"); len(f) > 0 {
+		t, err := parseUnix(f)
+		if err != nil {
+			apitools.Error(w, fmt.Errorf("from request variable is not a unix time: %s", f))
+			return
+		}
+		from = t
+	}
+
+	if t := r.URL.Query().Get("to"); len(t) > 0 {
+		tt, err := parseUnix(t)
+		if err != nil {
+			apitools.Error(w, fmt.Errorf("to request variable is not a unix time: %s", t))
+			return
+		}
+		to = tt
+	}
+
+	report, err := cache.Series(r.URL.Query().Get("run"), from, to)
+	if err != nil {
+		cacheErrors.With("series").Inc()
+		fmt.Printf("%s\n", err)
+	}
+
+	apitools.JSON(w, report)
+
+	return
+}
+
+func parseUnix(s string) (time.Time, error) {
+	i, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(i, 0), nil
+}
+
 func handleNodeList(w http.ResponseWriter, r *http.Request) {
 
-	list, err := cache.Generators()
+	list, err := cache.AllGenerators()
 	if err != nil {
+		cacheErrors.With("nodes").Inc()
 		fmt.Printf("%s\n", err)
 	}
 
@@ -84,6 +225,7 @@ func handleReceiverList(w http.ResponseWriter, r *http.Request) {
 
 	list, err := cache.Receivers()
 	if err != nil {
+		cacheErrors.With("receivers").Inc()
 		fmt.Printf("%s\n", err)
 	}
 
@@ -92,60 +234,358 @@ func handleReceiverList(w http.ResponseWriter, r *http.Request) {
 	return
 }
 
-func handleClear(w http.ResponseWriter, r *http.Request) {
+func handleRunList(w http.ResponseWriter, r *http.Request) {
 
-	list, err := cache.Receivers()
+	list, err := cache.Runs()
 	if err != nil {
+		cacheErrors.With("runs").Inc()
+		fmt.Printf("%s\n", err)
+	}
+
+	apitools.JSON(w, list)
+
+	return
+}
+
+func handleRunStart(w http.ResponseWriter, r *http.Request) {
+
+	run, err := cache.StartRun(r.URL.Query().Get("name"))
+	if err != nil {
+		cacheErrors.With("runs/start").Inc()
 		apitools.Error(w, err)
 		return
 	}
 
-	if err := cache.Clear(); err != nil {
+	apitools.JSON(w, run)
+
+	return
+}
+
+func handleClear(w http.ResponseWriter, r *http.Request) {
+
+	if err := cache.ClearRun(r.URL.Query().Get("run")); err != nil {
+		cacheErrors.With("clear").Inc()
 		apitools.Error(w, err)
 		return
 	}
 
-	for _, v := range list {
-		_, err := http.Get(strings.TrimSpace(v.Endpoint) + "/register")
+	apitools.Success(w, "cleared")
+
+	return
+}
+
+func handleDistribute(w http.ResponseWriter, r *http.Request) {
+
+	mode := "job"
+	if r.URL.Query().Get("wait") == "true" {
+		mode = "wait"
+	}
+
+	req, err := loadRequest(r)
+	if err != nil {
+		distributeCalls.With(mode, "invalid").Inc()
+		apitools.Error(w, err)
+		return
+	}
+
+	// A constant rate run is sized by qps and duration, and a profile by its
+	// stages, instead of n and c. A closed loop can run for a duration
+	// instead of n requests.
+	sized := len(req.QPS) > 0 || len(req.Profile) > 0
+
+	if !sized && len(req.N) == 0 && len(req.Duration) == 0 {
+		distributeCalls.With(mode, "invalid").Inc()
+		apitools.Error(w, errors.New("n or duration request variable not set"))
+		return
+	}
+
+	if !sized && len(req.C) == 0 {
+		distributeCalls.With(mode, "invalid").Inc()
+		apitools.Error(w, errors.New("c request variable not set"))
+		return
+	}
+
+	if len(req.URL) == 0 {
+		distributeCalls.With(mode, "invalid").Inc()
+		apitools.Error(w, errors.New("url request variable not set"))
+		return
+	}
+
+	timeout := req.Timeout(distributeTimeout)
+	if t := r.URL.Query().Get("timeout"); len(t) > 0 {
+		d, err := time.ParseDuration(t)
+		if err != nil {
+			distributeCalls.With(mode, "invalid").Inc()
+			apitools.Error(w, fmt.Errorf("timeout request variable is not a duration: %s", t))
+			return
+		}
+
+		// A timeout shorter than the run would cut every generator off
+		// partway through.
+		if length := req.Length(); d < length {
+			distributeCalls.With(mode, "invalid").Inc()
+			apitools.Respond(w, http.StatusBadRequest, fmt.Sprintf("{\"error\":\"timeout %s is shorter than the run, which takes %s\"}", d, length))
+			return
+		}
+		timeout = d
+	}
+
+	// Long runs outlive browser and load balancer timeouts, so by default the
+	// load is sent in the background and the caller polls the job.
+	if mode == "job" {
+		job, err := cache.StartJob(req, timeout)
 		if err != nil {
+			distributeCalls.With(mode, "error").Inc()
 			apitools.Error(w, err)
 			return
 		}
+
+		distributeCalls.With(mode, "ok").Inc()
+		apitools.JSON(w, job)
+		return
 	}
 
-	apitools.Success(w, "cleared")
+	// The request context is cancelled if the caller goes away, which stops
+	// the load on every generator.
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+
+	ab, err := cache.Distribute(ctx, req)
+	if err != nil {
+		distributeCalls.With(mode, "error").Inc()
+		fmt.Printf("%s\n", err)
+	} else {
+		distributeCalls.With(mode, "ok").Inc()
+	}
+
+	apitools.JSON(w, ab)
 
 	return
 }
 
-func handleDistribute(w http.ResponseWriter, r *http.Request) {
+// loadRequest reads the load to send. Profiles only fit in a JSON body, which
+// is posted, but simple runs can be given as request variables.
+func loadRequest(r *http.Request) (caching.LoadRequest, error) {
+	req := caching.LoadRequest{}
 
-	token := r.URL.Query().Get("token")
-	n := r.URL.Query().Get("n")
-	c := r.URL.Query().Get("c")
-	urltohit := r.URL.Query().Get("url")
+	if r.Method == http.MethodPost {
+		err := req.Load(r.Body)
+		return req, err
+	}
+
+	q := r.URL.Query()
+	req.N = q.Get("n")
+	req.C = q.Get("c")
+	req.URL = q.Get("url")
+	req.Token = q.Get("token")
+	req.QPS = q.Get("qps")
+	req.Duration = q.Get("duration")
+	req.Engine = q.Get("engine")
+	req.KeepAlive = q.Get("keepalive") == "true"
+
+	return req, nil
+}
+
+func handleJobList(w http.ResponseWriter, r *http.Request) {
+
+	list, err := cache.Jobs()
+	if err != nil {
+		cacheErrors.With("jobs").Inc()
+		fmt.Printf("%s\n", err)
+	}
+
+	apitools.JSON(w, list)
+
+	return
+}
+
+func handleJob(w http.ResponseWriter, r *http.Request) {
 
-	if len(n) == 0 {
-		apitools.Error(w, errors.New("n request variable not set"))
+	id := r.URL.Query().Get("id")
+	if len(id) == 0 {
+		apitools.Error(w, errors.New("id request variable not set"))
 		return
 	}
 
-	if len(c) == 0 {
-		apitools.Error(w, errors.New("c request variable not set"))
+	job, err := cache.Job(id)
+	if err != nil {
+		apitools.Error(w, fmt.Errorf("could not get job %s: %s", id, err))
 		return
 	}
 
-	if len(urltohit) == 0 {
-		apitools.Error(w, errors.New("url request variable not set"))
+	apitools.JSON(w, job)
+
+	return
+}
+
+// handleLogList lists the logs the generators kept for a token, or for a job
+// if the run had no token.
+func handleLogList(w http.ResponseWriter, r *http.Request) {
+
+	token := r.URL.Query().Get("token")
+	if len(token) == 0 {
+		apitools.Error(w, errors.New("token request variable not set"))
 		return
 	}
 
-	ab, err := cache.Distribute(n, c, urltohit, token)
+	list, err := cache.Logs(token)
 	if err != nil {
+		cacheErrors.With("logs").Inc()
 		fmt.Printf("%s\n", err)
 	}
 
-	apitools.JSON(w, ab)
+	apitools.JSON(w, list)
+
+	return
+}
+
+// handleLog downloads the log one generator kept for a token.
+func handleLog(w http.ResponseWriter, r *http.Request) {
+
+	token := r.URL.Query().Get("token")
+	if len(token) == 0 {
+		apitools.Error(w, errors.New("token request variable not set"))
+		return
+	}
+
+	generator := r.URL.Query().Get("generator")
+	if len(generator) == 0 {
+		apitools.Error(w, errors.New("generator request variable not set"))
+		return
+	}
+
+	data, err := cache.Log(token, generator)
+	if err != nil {
+		apitools.Error(w, fmt.Errorf("could not get log for %s from %s: %s", token, generator, err))
+		return
+	}
+
+	name := fmt.Sprintf("log_%s_%s.log", token, generator)
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	w.Write(data)
+
+	return
+}
+
+// handlePercentiles works out any percentiles of the latency of a finished
+// job from the histogram merged across its generators, like p=50,99,99.9.
+func handlePercentiles(w http.ResponseWriter, r *http.Request) {
+
+	id := r.URL.Query().Get("id")
+	if len(id) == 0 {
+		apitools.Error(w, errors.New("id request variable not set"))
+		return
+	}
+
+	ps := []float64{}
+	for _, s := range strings.Split(r.URL.Query().Get("p"), ",") {
+		p, err := strconv.ParseFloat(s, 64)
+		if err != nil || p < 0 || p > 100 {
+			apitools.Error(w, fmt.Errorf("p request variable is not a list of percentiles: %s", s))
+			return
+		}
+		ps = append(ps, p)
+	}
+
+	job, err := cache.Job(id)
+	if err != nil {
+		apitools.Error(w, fmt.Errorf("could not get job %s: %s", id, err))
+		return
+	}
+
+	if job.Result == nil || job.Result.Stats.Histogram == nil {
+		apitools.Error(w, fmt.Errorf("job %s has no latency histogram", id))
+		return
+	}
+
+	apitools.JSON(w, job.Result.Stats.Histogram.Percentiles(ps))
 
 	return
 }
+
+// handleAbort stops a running job on every generator.
+func handleAbort(w http.ResponseWriter, r *http.Request) {
+
+	id := r.URL.Query().Get("id")
+	if len(id) == 0 {
+		apitools.Error(w, errors.New("id request variable not set"))
+		return
+	}
+
+	client := &http.Client{Timeout: 5 * time.Second}
+
+	job, err := cache.AbortJob(id, client)
+	if err != nil {
+		apitools.Error(w, fmt.Errorf("could not abort job %s: %s", id, err))
+		return
+	}
+
+	apitools.JSON(w, job)
+
+	return
+}
+
+// handleProgress streams the progress of a job as server-sent events, one
+// aggregated report a second, until the job is over or the caller goes away.
+func handleProgress(w http.ResponseWriter, r *http.Request) {
+
+	id := r.URL.Query().Get("id")
+	if len(id) == 0 {
+		apitools.Error(w, errors.New("id request variable not set"))
+		return
+	}
+
+	if _, err := cache.Job(id); err != nil {
+		apitools.Error(w, fmt.Errorf("could not get job %s: %s", id, err))
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		apitools.Error(w, errors.New("streaming is not supported"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	ticker := time.NewTicker(progressInterval)
+	defer ticker.Stop()
+
+	for {
+		job, err := cache.Job(id)
+		if err != nil {
+			fmt.Printf("%s\n", err)
+		}
+
+		report, err := cache.Progress(id)
+		if err != nil {
+			fmt.Printf("%s\n", err)
+		}
+
+		data, err := report.JSON()
+		if err != nil {
+			fmt.Printf("%s\n", err)
+			return
+		}
+
+		event := "progress"
+		if job.Status != caching.JobRunning {
+			event = "done"
+		}
+
+		fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data)
+		flusher.Flush()
+
+		if event == "done" {
+			return
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
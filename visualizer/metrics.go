@@ -0,0 +1,14 @@
+package main
+
+import (
+	"github.com/tpryan/scaling/metrics"
+)
+
+var (
+	registry = metrics.NewRegistry()
+
+	distributeCalls = registry.NewCounter("visualizer_distribute_calls_total",
+		"Calls to distribute load, by whether they ran as a job or waited, and how they went.", "mode", "result")
+	cacheErrors = registry.NewCounter("visualizer_cache_errors_total",
+		"Cache calls that failed, by what they were for.", "op")
+)
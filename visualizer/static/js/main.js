@@ -1,6 +1,7 @@
 document.addEventListener('DOMContentLoaded', function() {
     document.querySelector(".send").addEventListener("click", distribute);  
     document.querySelector(".clear").addEventListener("click", clear); 
+    document.querySelector(".abort").addEventListener("click", abort); 
     document.querySelector("#loadcount").addEventListener("change", synchLoadUI); 
     getReceivers();
     synchLoadUI();
@@ -10,6 +11,8 @@ document.addEventListener('DOMContentLoaded', function() {
 });
 
 
+var currentJob = "";
+
 function distribute() {
     document.querySelector(".send").disabled = true;
     var xhttp = new XMLHttpRequest();
@@ -19,6 +22,10 @@ function distribute() {
          if (this.readyState == 4 && this.status == 200) {
             console.log("Fireing load - success");
             console.log(this.responseText);
+            var id = JSON.parse(this.responseText).id;
+            currentJob = id;
+            pollJob(id);
+            watchProgress(id);
          }
     };
 
@@ -37,6 +44,39 @@ function distribute() {
     xhttp.send();
 }
 
+function pollJob(id) {
+    var xhttp = new XMLHttpRequest();
+    xhttp.onreadystatechange = function() {
+         if (this.readyState == 4 && this.status == 200) {
+            var job = JSON.parse(this.responseText);
+            console.log("Job", job.id, job.status);
+            if (job.status == "running") {
+                setTimeout(pollJob, 1000, id);
+                return;
+            }
+            console.log(job.result);
+         }
+    };
+    xhttp.open("GET", `/api/job?id=${id}`, true);
+    xhttp.setRequestHeader("Content-type", "application/json");
+    xhttp.send();
+}
+
+function watchProgress(id) {
+    var source = new EventSource(`/api/progress?id=${id}`);
+    var show = function(e) {
+        var progress = JSON.parse(e.data);
+        document.querySelector("#progress").textContent =
+            `${progress.sent} sent, ${progress.errors} errors, ` +
+            `${Math.round(progress.rate)} req/s, ${Math.round(progress.meanlatencyms)} ms mean`;
+    };
+    source.addEventListener("progress", show);
+    source.addEventListener("done", function(e) {
+        show(e);
+        source.close();
+    });
+}
+
 function pollLoad() {
     var xhttp = new XMLHttpRequest();
     xhttp.onreadystatechange = function() {
@@ -88,6 +128,9 @@ function loadReceivers(content){
         var opt = document.createElement("option");
         opt.value = receiver.endpoint;
         opt.text = `${receiver.env} (${receiver.endpoint})  `;
+        if (receiver.health) {
+            opt.text += receiver.health.up ? `up ${receiver.health.latencyms}ms` : "down";
+        }
         select.appendChild(opt);
     });
 }
@@ -113,6 +156,7 @@ function updateInstance(instance){
 
     if (ui != null) {
         document.querySelector(id + " .count").innerHTML = instance.count;  
+        ui.dataset.state = instance.state;
     } else {
         var envType = instance.env.toLowerCase();
 
@@ -158,6 +202,7 @@ function updateInstance(instance){
         instanceDiv.id = "instance-" + instance.id;
         instanceDiv.classList.add(envType);
         instanceDiv.classList.add("instance");
+        instanceDiv.dataset.state = instance.state;
         
         var countDiv = document.createElement("div");
         countDiv.innerHTML = instance.count;  
@@ -215,12 +260,21 @@ function updateLoadGenerator(node){
         } else{
            ui.classList.remove("active");  
         }
+
+        if (node.stale){
+           ui.classList.add("stale");  
+        } else{
+           ui.classList.remove("stale");  
+        }
         
     } else {
 
         var nodeDiv = document.createElement("div");
         nodeDiv.id = "generator-" + node.id;
         nodeDiv.classList.add("node")
+        if (node.stale){
+           nodeDiv.classList.add("stale");  
+        }
 
         var idDiv = document.createElement("div");
         idDiv.innerHTML = node.id;  
@@ -237,6 +291,24 @@ function updateLoadGenerator(node){
 
 }
 
+function abort() {
+    if (currentJob == "") {
+        return;
+    }
+    console.log("Abort called", currentJob)
+    var xhttp = new XMLHttpRequest();
+    xhttp.onreadystatechange = function() {
+         if (this.readyState == 4) {
+            console.log(this.responseText);
+            currentJob = "";
+            document.querySelector(".send").disabled = false;
+         }
+    };
+    xhttp.open("GET", `/api/abort?id=${currentJob}`, true);
+    xhttp.setRequestHeader("Content-type", "application/json");
+    xhttp.send();
+}
+
 function clear() {
     console.log("Clear called")
     document.querySelector(".send").disabled = false;
@@ -248,7 +320,7 @@ function clear() {
             document.querySelector(".load-info").innerHTML = "";
          }
     };
-    xhttp.open("GET", "/api/clear", true);
+    xhttp.open("GET", "/api/runs/start", true);
     xhttp.setRequestHeader("Content-type", "application/json");
     xhttp.send();
 }